@@ -0,0 +1,199 @@
+// Administrative commands, for test setup and chaos while load is running.
+
+package mctester
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+var ErrCommandFailed = errors.New("command did not return OK")
+
+// adminCmd sends a single line command and expects OK back. Other single
+// line replies (ie; BUSY or BADCLASS from slabs reassign) come back wrapped
+// in ErrCommandFailed.
+func (c *Client) adminCmd(cmd string) (err error) {
+	err = c.runNow("", len(cmd)+2, func() error {
+		b := c.cn.b
+		b.WriteString(cmd)
+		b.WriteString("\r\n")
+		if err := b.Flush(); err != nil {
+			return err
+		}
+
+		line, err := b.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(line, []byte("OK\r\n")) {
+			return nil
+		}
+		if err := textError(line); err != ErrUnexpectedResponse {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrCommandFailed, bytes.TrimSpace(line))
+	})
+	return
+}
+
+// Version returns the server version string.
+func (c *Client) Version() (version string, err error) {
+	err = c.runNow("", 9, func() error {
+		b := c.cn.b
+		b.WriteString("version\r\n")
+		if err := b.Flush(); err != nil {
+			return err
+		}
+
+		line, err := b.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(line, []byte("VERSION ")) {
+			return textError(line)
+		}
+		version = string(line[8 : len(line)-2])
+		return nil
+	})
+	return
+}
+
+// FlushAll invalidates every item, after delay seconds if non-zero.
+func (c *Client) FlushAll(delay uint32) error {
+	if delay == 0 {
+		return c.adminCmd("flush_all")
+	}
+	return c.adminCmd("flush_all " + strconv.FormatUint(uint64(delay), 10))
+}
+
+// Verbosity sets the server's logging level.
+func (c *Client) Verbosity(level uint) error {
+	return c.adminCmd("verbosity " + strconv.FormatUint(uint64(level), 10))
+}
+
+// CacheMemlimit changes the server's memory limit, in megabytes.
+func (c *Client) CacheMemlimit(megabytes uint) error {
+	return c.adminCmd("cache_memlimit " + strconv.FormatUint(uint64(megabytes), 10))
+}
+
+// SlabsReassign moves a page from slab class src to dst. A src of -1 takes
+// a page from any class.
+func (c *Client) SlabsReassign(src int, dst int) error {
+	return c.adminCmd("slabs reassign " + strconv.Itoa(src) + " " + strconv.Itoa(dst))
+}
+
+// SlabsAutomove sets the slab automover mode: 0 off, 1 on, 2 aggressive.
+func (c *Client) SlabsAutomove(mode uint) error {
+	return c.adminCmd("slabs automove " + strconv.FormatUint(uint64(mode), 10))
+}
+
+// LruCrawler sends an lru_crawler subcommand, ie; "enable", "disable",
+// "crawl all", "sleep 100" or "tocrawl 0". See MetaDump for metadump.
+func (c *Client) LruCrawler(subcommand string) error {
+	return c.adminCmd("lru_crawler " + subcommand)
+}
+
+// MetaDumpEntry is one item from an lru_crawler metadump.
+type MetaDumpEntry struct {
+	Key        string
+	Exp        int64  // unix time, or -1 for no expiration
+	LastAccess uint64 // unix time
+	CAS        uint64
+	Fetched    bool
+	Class      int
+	Size       uint64
+}
+
+// parseMetaDumpLine parses "key=foo exp=-1 la=123 cas=2 fetch=no cls=1 size=63".
+// Unknown fields are skipped so newer servers can add more.
+func parseMetaDumpLine(line []byte, e *MetaDumpEntry) (err error) {
+	*e = MetaDumpEntry{}
+	for _, field := range bytes.Fields(line) {
+		i := bytes.IndexByte(field, '=')
+		if i == -1 {
+			return ErrUnexpectedResponse
+		}
+		name, v := string(field[:i]), field[i+1:]
+		switch name {
+		case "key":
+			// keys are URI encoded in the dump.
+			e.Key, err = url.PathUnescape(string(v))
+		case "exp":
+			e.Exp, err = strconv.ParseInt(string(v), 10, 64)
+		case "la":
+			e.LastAccess, err = parseMetaUint(v)
+		case "cas":
+			e.CAS, err = parseMetaUint(v)
+		case "fetch":
+			e.Fetched = bytes.Equal(v, []byte("yes"))
+		case "cls":
+			var cls uint64
+			cls, err = parseMetaUint(v)
+			e.Class = int(cls)
+		case "size":
+			e.Size, err = parseMetaUint(v)
+		}
+		if err != nil {
+			return ErrUnexpectedResponse
+		}
+	}
+	if e.Key == "" {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// MetaDump streams an lru_crawler metadump through fn, one call per resident
+// item. classes is "all" or a comma separated list of slab class ids. If fn
+// returns an error the rest of the dump is read and dropped so the
+// connection stays usable, then that error is returned.
+func (c *Client) MetaDump(classes string, fn func(e MetaDumpEntry) error) (err error) {
+	err = c.runNow("", len(classes)+24, func() error {
+		b := c.cn.b
+		b.WriteString("lru_crawler metadump ")
+		b.WriteString(classes)
+		b.WriteString("\r\n")
+		if err := b.Flush(); err != nil {
+			return err
+		}
+
+		var fnErr error
+		e := MetaDumpEntry{}
+		first := true
+		for {
+			// Dumps can run long; NetTimeout applies per line.
+			if err := c.refreshDeadline(); err != nil {
+				return err
+			}
+			line, err := b.ReadBytes('\n')
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, []byte("END\r\n")) {
+				return fnErr
+			}
+			if !bytes.HasPrefix(line, []byte("key=")) {
+				if first {
+					// crawler busy or bad class list; nothing else follows.
+					if err := textError(line); err != ErrUnexpectedResponse {
+						return err
+					}
+					return fmt.Errorf("%w: %s", ErrCommandFailed, bytes.TrimSpace(line))
+				}
+				return ErrUnexpectedResponse
+			}
+			first = false
+			if fnErr != nil {
+				continue
+			}
+			if err := parseMetaDumpLine(line, &e); err != nil {
+				return err
+			}
+			fnErr = fn(e)
+		}
+	})
+	return
+}
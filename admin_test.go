@@ -0,0 +1,112 @@
+package mctester
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"version\r\n", "VERSION 1.6.21\r\n",
+		"flush_all\r\n", "OK\r\n",
+		"flush_all 30\r\n", "OK\r\n",
+		"verbosity 1\r\n", "OK\r\n",
+		"cache_memlimit 64\r\n", "OK\r\n",
+		"slabs reassign -1 5\r\n", "OK\r\n",
+		"slabs reassign 1 1\r\n", "SAME src and dst class are identical\r\n",
+		"slabs automove 2\r\n", "OK\r\n",
+		"lru_crawler crawl all\r\n", "BUSY currently processing crawler request\r\n",
+		"lru_crawler enable\r\n", "OK\r\n",
+		"lru_crawler bogus\r\n", "CLIENT_ERROR bad command line format\r\n",
+		"version\r\n", "VERSION 1.6.21\r\n",
+	))
+
+	if v, err := mc.Version(); err != nil || v != "1.6.21" {
+		t.Fatalf("bad version: %q %v", v, err)
+	}
+
+	ok := []func() error{
+		func() error { return mc.FlushAll(0) },
+		func() error { return mc.FlushAll(30) },
+		func() error { return mc.Verbosity(1) },
+		func() error { return mc.CacheMemlimit(64) },
+		func() error { return mc.SlabsReassign(-1, 5) },
+	}
+	for i, fn := range ok {
+		if err := fn(); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+
+	if err := mc.SlabsReassign(1, 1); !errors.Is(err, ErrCommandFailed) {
+		t.Fatalf("expected command failure, got: %v", err)
+	}
+	if err := mc.SlabsAutomove(2); err != nil {
+		t.Fatalf("automove error: %v", err)
+	}
+	if err := mc.LruCrawler("crawl all"); !errors.Is(err, ErrCommandFailed) {
+		t.Fatalf("expected busy crawler, got: %v", err)
+	}
+	if err := mc.LruCrawler("enable"); err != nil {
+		t.Fatalf("crawler enable error: %v", err)
+	}
+	if err := mc.LruCrawler("bogus"); !errors.Is(err, ErrClientError) {
+		t.Fatalf("expected client error, got: %v", err)
+	}
+	// errors above shouldn't have cost us the connection.
+	if _, err := mc.Version(); err != nil || mc.ConnStats().Connects != 1 {
+		t.Fatalf("connection lost after error replies: %v %+v", err, mc.ConnStats())
+	}
+}
+
+func TestMetaDump(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"lru_crawler metadump all\r\n",
+		"key=foo exp=-1 la=1700000000 cas=2 fetch=no cls=1 size=63\r\n"+
+			"key=b%3Aar exp=1700000300 la=1700000001 cas=3 fetch=yes cls=5 size=1200 flags=0\r\n"+
+			"END\r\n",
+		"lru_crawler metadump 1,2\r\n",
+		"key=foo exp=-1 la=1 cas=2 fetch=no cls=1 size=63\r\nkey=bar exp=-1 la=1 cas=3 fetch=no cls=2 size=63\r\nEND\r\n",
+		"lru_crawler metadump all\r\n", "BUSY currently processing crawler request\r\n",
+		"lru_crawler metadump all\r\n", "END\r\n",
+	))
+
+	var entries []MetaDumpEntry
+	err := mc.MetaDump("all", func(e MetaDumpEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("metadump error: %v", err)
+	}
+	want := []MetaDumpEntry{
+		{Key: "foo", Exp: -1, LastAccess: 1700000000, CAS: 2, Class: 1, Size: 63},
+		{Key: "b:ar", Exp: 1700000300, LastAccess: 1700000001, CAS: 3, Fetched: true, Class: 5, Size: 1200},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Fatalf("entry %d: expected %+v, got %+v", i, want[i], entries[i])
+		}
+	}
+
+	// stopping early still reads through to END.
+	stop := errors.New("stop")
+	calls := 0
+	err = mc.MetaDump("1,2", func(e MetaDumpEntry) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("expected stop after one entry, got %v after %d", err, calls)
+	}
+
+	if err := mc.MetaDump("all", nil); !errors.Is(err, ErrCommandFailed) {
+		t.Fatalf("expected busy crawler, got: %v", err)
+	}
+	if err := mc.MetaDump("all", nil); err != nil {
+		t.Fatalf("empty metadump error: %v", err)
+	}
+}
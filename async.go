@@ -0,0 +1,388 @@
+// Pipelined client for many goroutines sharing one connection: a writer
+// goroutine batches queued requests into as few flushes as it can, and a
+// reader goroutine hands responses back to the requests they belong to.
+
+package mctester
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrAsyncClosed = errors.New("async client closed")
+	ErrAsyncQuiet  = errors.New("quiet requests need MatchOpaque")
+)
+
+// AsyncOptions changes how an AsyncClient matches responses.
+type AsyncOptions struct {
+	// MatchOpaque tags every request with an opaque and matches responses
+	// by it. Quiet requests are only allowed with this on. Otherwise
+	// responses are matched strictly in order.
+	MatchOpaque bool
+}
+
+// AsyncStats counts traffic, to compare syscall patterns with other
+// clients.
+type AsyncStats struct {
+	Requests  uint64
+	Flushes   uint64 // one write syscall each, give or take oversized values
+	Responses uint64
+}
+
+// MetaFuture is the pending result of a request sent through an
+// AsyncClient.
+type MetaFuture struct {
+	req   MetaRequest
+	flags MetaFlags
+	value []byte
+	arith *MetaArith
+	done  chan struct{}
+	res   *MetaResponse
+	err   error
+}
+
+// Done is closed once the result is in.
+func (f *MetaFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks for the response. A quiet request that got no response (a
+// miss for mg, success for the rest) returns a nil response and no error;
+// that's only known once a later response arrives, so end quiet batches
+// with a Noop.
+func (f *MetaFuture) Wait() (*MetaResponse, error) {
+	<-f.done
+	return f.res, f.err
+}
+
+// WaitTimeout is Wait giving up after d with ErrTimeout. The request stays
+// in flight.
+func (f *MetaFuture) WaitTimeout(d time.Duration) (*MetaResponse, error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-f.done:
+		return f.res, f.err
+	case <-t.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (f *MetaFuture) resolve(res *MetaResponse, err error) {
+	if res != nil {
+		res.Request = f.req
+	}
+	f.res = res
+	f.err = err
+	close(f.done)
+}
+
+// AsyncClient sends meta requests from any number of goroutines over one
+// connection. It doesn't reconnect: after a connection error every request
+// fails with that error, and a new AsyncClient is needed.
+type AsyncClient struct {
+	opts AsyncOptions
+	cn   *mcConn
+	// NetTimeout bounds each flush.
+	netTimeout time.Duration
+	// writer side, only touched by the writer goroutine.
+	wc *Client
+
+	mu      sync.Mutex
+	queue   []*MetaFuture // submitted, not yet written
+	pending []*MetaFuture // written, awaiting a response, oldest first
+	closed  bool
+	err     error
+	opaque  uint32
+	wake    chan struct{}
+	quit    chan struct{}
+	wg      sync.WaitGroup
+
+	requests  uint64
+	flushes   uint64
+	responses uint64
+}
+
+// NewAsyncClient opens a connection configured like c (host, buffers,
+// auth, TLS) and starts the writer and reader. c itself isn't used after.
+func NewAsyncClient(c *Client, opts AsyncOptions) (*AsyncClient, error) {
+	cn, err := c.connectToMc()
+	if err != nil {
+		return nil, err
+	}
+	a := &AsyncClient{
+		opts:       opts,
+		cn:         cn,
+		netTimeout: c.NetTimeout,
+		// Deadlines are handled here, not by the Client; one set on the
+		// conn would hit the reader too.
+		wc:   &Client{Host: c.Host, cn: cn},
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+	a.wg.Add(2)
+	go a.writer()
+	go a.reader()
+	return a, nil
+}
+
+// Get queues an mg.
+func (a *AsyncClient) Get(key string, f MetaFlags) *MetaFuture {
+	return a.submit(&MetaFuture{req: MetaRequest{Cmd: "mg", Key: key}, flags: f}, metaCmdGet)
+}
+
+// Set queues an ms.
+func (a *AsyncClient) Set(key string, f MetaFlags, value []byte) *MetaFuture {
+	return a.submit(&MetaFuture{req: MetaRequest{Cmd: "ms", Key: key}, flags: f, value: value}, metaCmdSet)
+}
+
+// Delete queues an md.
+func (a *AsyncClient) Delete(key string, f MetaFlags) *MetaFuture {
+	return a.submit(&MetaFuture{req: MetaRequest{Cmd: "md", Key: key}, flags: f}, metaCmdDelete)
+}
+
+// Arithmetic queues an ma.
+func (a *AsyncClient) Arithmetic(key string, arith *MetaArith, f MetaFlags) *MetaFuture {
+	return a.submit(&MetaFuture{req: MetaRequest{Cmd: "ma", Key: key}, flags: f, arith: arith}, metaCmdArith)
+}
+
+// Noop queues an mn, which flushes out quiet requests queued before it.
+func (a *AsyncClient) Noop() *MetaFuture {
+	return a.submit(&MetaFuture{req: MetaRequest{Cmd: "mn"}}, 0)
+}
+
+// submit checks a request in the caller's goroutine, so bad requests never
+// reach the writer, then queues it.
+func (a *AsyncClient) submit(f *MetaFuture, cmd metaCmd) *MetaFuture {
+	f.done = make(chan struct{})
+	var err error
+	switch {
+	case len(f.req.Key) > 250:
+		err = ErrKeyTooLong
+	case cmd == metaCmdArith && f.arith == nil:
+		err = ErrBadBatch
+	case cmd != 0:
+		err = f.flags.validate(cmd)
+	}
+	if err != nil {
+		f.resolve(nil, err)
+		return f
+	}
+	f.req.Quiet = f.flags.has(mfQuiet)
+	if f.req.Quiet && !a.opts.MatchOpaque {
+		f.resolve(nil, ErrAsyncQuiet)
+		return f
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		err := a.err
+		a.mu.Unlock()
+		f.resolve(nil, err)
+		return f
+	}
+	a.queue = append(a.queue, f)
+	a.mu.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+		// writer already has a wakeup coming.
+	}
+	return f
+}
+
+// writer takes everything queued since its last pass and writes it with
+// one flush. Requests queue up while a flush is in progress, so batches
+// grow with load.
+func (a *AsyncClient) writer() {
+	defer a.wg.Done()
+	var batch []*MetaFuture
+	for {
+		select {
+		case <-a.wake:
+		case <-a.quit:
+			return
+		}
+
+		a.mu.Lock()
+		batch, a.queue = a.queue, batch[:0]
+		// Pending before written, so the reader can't see a response for
+		// a request it doesn't know about.
+		for _, f := range batch {
+			if a.opts.MatchOpaque && f.req.Cmd != "mn" {
+				a.opaque++
+				f.req.Opaque = a.opaque
+				f.flags = f.flags.WithOpaque(a.opaque)
+			}
+			a.pending = append(a.pending, f)
+		}
+		a.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+
+		// Writes can flush on their own when the buffer fills, so the
+		// deadline has to be in place before any of them.
+		if a.netTimeout != 0 {
+			a.cn.conn.SetWriteDeadline(time.Now().Add(a.netTimeout))
+		}
+		for _, f := range batch {
+			if err := a.write(f); err != nil {
+				a.shutdown(err)
+				return
+			}
+		}
+		if err := a.cn.b.Flush(); err != nil {
+			a.shutdown(err)
+			return
+		}
+		atomic.AddUint64(&a.requests, uint64(len(batch)))
+		atomic.AddUint64(&a.flushes, 1)
+		// Don't hold on to finished futures.
+		for i := range batch {
+			batch[i] = nil
+		}
+	}
+}
+
+func (a *AsyncClient) write(f *MetaFuture) error {
+	key := f.req.Key
+	switch f.req.Cmd {
+	case "mg":
+		return a.wc.MetaGetFlags(key, f.flags)
+	case "ms":
+		return a.wc.MetaSetFlags(key, f.flags, f.value)
+	case "md":
+		return a.wc.MetaDeleteFlags(key, f.flags)
+	case "ma":
+		return a.wc.MetaArithmeticFlags(key, f.arith, f.flags)
+	}
+	return a.wc.MetaNoop()
+}
+
+func (a *AsyncClient) reader() {
+	defer a.wg.Done()
+	rc := &Client{cn: a.cn}
+	for {
+		r := &MetaResponse{}
+		err := rc.ParseMetaResponseInto(r)
+		if err != nil && isConnErr(err) {
+			a.shutdown(err)
+			return
+		}
+		// Anything else (ie; SERVER_ERROR) leaves the stream usable and
+		// belongs to a request.
+		f, merr := a.match(r)
+		if merr != nil {
+			a.shutdown(merr)
+			return
+		}
+		atomic.AddUint64(&a.responses, 1)
+		f.resolve(r, err)
+	}
+}
+
+// match takes the request a response belongs to off the pending list. By
+// opaque, quiet requests skipped over got no response and are resolved as
+// such, and requests that weren't quiet get ErrOutOfOrder, the same as
+// Client.matchInflight.
+func (a *AsyncClient) match(r *MetaResponse) (*MetaFuture, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) == 0 {
+		return nil, ErrNoInflight
+	}
+
+	var match func(f *MetaFuture) bool
+	switch {
+	case !a.opts.MatchOpaque:
+		match = func(f *MetaFuture) bool { return true }
+	case r.Code == McMN:
+		match = func(f *MetaFuture) bool { return f.req.Cmd == "mn" }
+	case r.Opaque != nil:
+		opaque, err := parseMetaUint(r.Opaque)
+		if err != nil {
+			return nil, ErrUnknownOpaque
+		}
+		match = func(f *MetaFuture) bool { return uint64(f.req.Opaque) == opaque }
+	default:
+		// Error lines carry no opaque; has to be the oldest.
+		match = func(f *MetaFuture) bool { return true }
+	}
+
+	i := 0
+	for ; i < len(a.pending); i++ {
+		if match(a.pending[i]) {
+			break
+		}
+	}
+	if i == len(a.pending) {
+		return nil, ErrUnknownOpaque
+	}
+	for _, skipped := range a.pending[:i] {
+		if skipped.req.Quiet {
+			skipped.resolve(nil, nil)
+		} else {
+			skipped.resolve(nil, ErrOutOfOrder)
+		}
+	}
+	f := a.pending[i]
+	// Shift down rather than reslice so the backing array gets reused.
+	n := copy(a.pending, a.pending[i+1:])
+	for j := n; j < len(a.pending); j++ {
+		a.pending[j] = nil
+	}
+	a.pending = a.pending[:n]
+	return f, nil
+}
+
+// shutdown fails everything queued or in flight with err, once, and stops
+// the writer and reader.
+func (a *AsyncClient) shutdown(err error) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	a.err = err
+	queue, pending := a.queue, a.pending
+	a.queue, a.pending = nil, nil
+	close(a.quit)
+	a.mu.Unlock()
+
+	a.cn.conn.Close()
+	for _, f := range pending {
+		f.resolve(nil, err)
+	}
+	for _, f := range queue {
+		f.resolve(nil, err)
+	}
+}
+
+// Err returns the error that stopped the client, if any.
+func (a *AsyncClient) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// Close fails anything outstanding with ErrAsyncClosed and waits for the
+// writer and reader to stop.
+func (a *AsyncClient) Close() {
+	a.shutdown(ErrAsyncClosed)
+	a.wg.Wait()
+}
+
+// Stats returns the traffic counters.
+func (a *AsyncClient) Stats() AsyncStats {
+	return AsyncStats{
+		Requests:  atomic.LoadUint64(&a.requests),
+		Flushes:   atomic.LoadUint64(&a.flushes),
+		Responses: atomic.LoadUint64(&a.responses),
+	}
+}
@@ -0,0 +1,203 @@
+package mctester
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metaEchoServer answers mg with the key as the value, or a miss for keys
+// starting with "miss", ms with HD, and mn with MN. Opaques are echoed and
+// quiet misses get no response, like memcached.
+func metaEchoServer(t *testing.T) string {
+	return fakeServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		w := bufio.NewWriter(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			parts := strings.Fields(line)
+			opaque, quiet := "", false
+			for _, p := range parts[1:] {
+				if p == "q" {
+					quiet = true
+				} else if strings.HasPrefix(p, "O") {
+					opaque = " " + p
+				}
+			}
+			switch parts[0] {
+			case "mg":
+				key := parts[1]
+				if strings.HasPrefix(key, "miss") {
+					if !quiet {
+						fmt.Fprintf(w, "EN%s\r\n", opaque)
+					}
+				} else {
+					fmt.Fprintf(w, "VA %d%s\r\n%s\r\n", len(key), opaque, key)
+				}
+			case "ms":
+				r.ReadString('\n')
+				if !quiet {
+					fmt.Fprintf(w, "HD%s\r\n", opaque)
+				}
+			case "mn":
+				w.WriteString("MN\r\n")
+			default:
+				w.WriteString("ERROR\r\n")
+			}
+			// only flush once the request pipeline is drained.
+			if r.Buffered() == 0 {
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+func TestAsyncConcurrent(t *testing.T) {
+	for _, opaque := range []bool{false, true} {
+		a, err := NewAsyncClient(newcliHost(metaEchoServer(t)), AsyncOptions{MatchOpaque: opaque})
+		if err != nil {
+			t.Fatalf("async client error: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for g := 0; g < 20; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				futures := make([]*MetaFuture, 50)
+				for i := range futures {
+					futures[i] = a.Get("key"+strconv.Itoa(g)+":"+strconv.Itoa(i), MetaFlags{}.WithValue())
+				}
+				for i, f := range futures {
+					key := "key" + strconv.Itoa(g) + ":" + strconv.Itoa(i)
+					r, err := f.WaitTimeout(time.Second)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if r.Code != McVA || string(r.Value) != key || r.Request.Key != key {
+						errs <- fmt.Errorf("bad response for %s: %d %q", key, r.Code, r.Value)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("opaque %v: %v", opaque, err)
+		}
+
+		s := a.Stats()
+		if s.Requests != 1000 || s.Responses != 1000 || s.Flushes == 0 || s.Flushes > s.Requests {
+			t.Fatalf("bad stats: %+v", s)
+		}
+		a.Close()
+	}
+}
+
+func TestAsyncQuiet(t *testing.T) {
+	host := metaEchoServer(t)
+	a, err := NewAsyncClient(newcliHost(host), AsyncOptions{})
+	if err != nil {
+		t.Fatalf("async client error: %v", err)
+	}
+	if _, err := a.Get("foo", MetaFlags{}.Quiet()).Wait(); err != ErrAsyncQuiet {
+		t.Fatalf("expected quiet error without opaques, got: %v", err)
+	}
+	a.Close()
+
+	a, err = NewAsyncClient(newcliHost(host), AsyncOptions{MatchOpaque: true})
+	if err != nil {
+		t.Fatalf("async client error: %v", err)
+	}
+	defer a.Close()
+	get := MetaFlags{}.WithValue().Quiet()
+	miss := a.Get("miss1", get)
+	set := a.Set("foo", MetaFlags{}.Quiet(), []byte("bar"))
+	hit := a.Get("hit", get)
+	noop := a.Noop()
+
+	if r, err := miss.Wait(); r != nil || err != nil {
+		t.Fatalf("expected suppressed miss, got: %+v %v", r, err)
+	}
+	if r, err := set.Wait(); r != nil || err != nil {
+		t.Fatalf("expected suppressed set, got: %+v %v", r, err)
+	}
+	if r, err := hit.Wait(); err != nil || r.Code != McVA || string(r.Value) != "hit" {
+		t.Fatalf("bad quiet hit: %+v %v", r, err)
+	}
+	if r, err := noop.Wait(); err != nil || r.Code != McMN {
+		t.Fatalf("bad noop: %+v %v", r, err)
+	}
+}
+
+// A batch that flushes part way through writing must not run into the
+// last batch's write deadline.
+func TestAsyncWriteDeadline(t *testing.T) {
+	mc := newcliHost(metaEchoServer(t))
+	mc.NetTimeout = 50 * time.Millisecond
+	mc.WBufSize = 4096
+	a, err := NewAsyncClient(mc, AsyncOptions{})
+	if err != nil {
+		t.Fatalf("async client error: %v", err)
+	}
+	defer a.Close()
+	if _, err := a.Get("foo", MetaFlags{}.WithValue()).Wait(); err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	time.Sleep(4 * mc.NetTimeout)
+	value := []byte(strings.Repeat("v", 20*1024))
+	if r, err := a.Set("foo", MetaFlags{}, value).Wait(); err != nil || r.Code != McHD {
+		t.Fatalf("bad set after idle: %+v %v", r, err)
+	}
+}
+
+func TestAsyncClose(t *testing.T) {
+	// Server reads requests and never answers, then hangs up.
+	hangup := make(chan struct{})
+	host := fakeServer(t, func(conn net.Conn) {
+		go io.Copy(io.Discard, conn)
+		<-hangup
+	})
+	a, err := NewAsyncClient(newcliHost(host), AsyncOptions{})
+	if err != nil {
+		t.Fatalf("async client error: %v", err)
+	}
+	f := a.Get("foo", MetaFlags{}.WithValue())
+	if _, err := f.WaitTimeout(10 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected wait timeout, got: %v", err)
+	}
+	close(hangup)
+	if _, err := f.Wait(); err == nil {
+		t.Fatalf("expected error after server hung up")
+	}
+	if _, err := a.Get("foo", MetaFlags{}).Wait(); err == nil || err != a.Err() {
+		t.Fatalf("expected client error for new requests, got: %v", err)
+	}
+	a.Close()
+
+	a, err = NewAsyncClient(newcliHost(metaEchoServer(t)), AsyncOptions{})
+	if err != nil {
+		t.Fatalf("async client error: %v", err)
+	}
+	a.Close()
+	if _, err := a.Noop().Wait(); err != ErrAsyncClosed {
+		t.Fatalf("expected closed error, got: %v", err)
+	}
+	if _, err := a.Get(strings.Repeat("k", 251), MetaFlags{}).Wait(); err != ErrKeyTooLong {
+		t.Fatalf("expected key too long, got: %v", err)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"math/rand"
 	"os"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgryski/go-pcgr"
@@ -33,9 +36,21 @@ func main() {
 	valueSize := flag.Uint("valuesize", 1000, "size of value (in bytes) to store on miss")
 	clientFlags := flag.Uint("clientflags", 0, "(32bit unsigned) client flag bits to set on miss")
 	pipelines := flag.Uint("pipelines", 1, "(32bit unsigned) stack this many GET requests into the same syscall.")
-	server := flag.String("server", "127.0.0.1:11211", "ip and port to connect to")
+	server := flag.String("server", "127.0.0.1:11211", "ip and port to connect to, or a comma separated list")
+	selector := flag.String("selector", "modulo", "how keys are spread over servers: modulo, crc32 or ketama")
+	serverPcts := flag.String("serverpcts", "", "comma separated percentage of traffic per server, instead of spreading by key")
+	splitBy := flag.String("splitby", "conns", "split traffic by percentage of conns or requests")
 	socket := flag.String("socket", "", "domain socket to connect to")
 	stripKeyPrefix := flag.Bool("stripkeyprefix", false, "strip key prefix before comparing with response.")
+	username := flag.String("username", "", "username for servers with an auth file (-Y)")
+	password := flag.String("password", "", "password for servers with an auth file (-Y)")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	tlsCAFile := flag.String("tlscafile", "", "CA bundle to verify the server with (default system roots)")
+	tlsCert := flag.String("tlscert", "", "client certificate file")
+	tlsKey := flag.String("tlskey", "", "client key file")
+	tlsServerName := flag.String("tlsservername", "", "server name to verify (default server host)")
+	tlsSkipVerify := flag.Bool("tlsskipverify", false, "don't verify the server certificate")
+	tlsSessionCache := flag.Int("tlssessioncache", 0, "number of TLS sessions to cache for resumption (0 disables)")
 
 	flag.Parse()
 
@@ -58,7 +73,7 @@ func main() {
 	*/
 
 	bl := &BasicLoader{
-		servers:               []string{*server},
+		servers:               strings.Split(*server, ","),
 		socket:                *socket,
 		pipelines:             *pipelines,
 		stripKeyPrefix:        *stripKeyPrefix,
@@ -76,6 +91,53 @@ func main() {
 		zipfV:                 *zipfV,
 		valueSize:             *valueSize,
 		clientFlags:           *clientFlags,
+		username:              *username,
+		password:              *password,
+	}
+
+	sel, err := mct.NewSelector(*selector, bl.servers, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	bl.selector = sel
+
+	if *serverPcts != "" {
+		var pcts []int
+		for _, p := range strings.Split(*serverPcts, ",") {
+			pct, err := strconv.Atoi(p)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			pcts = append(pcts, pct)
+		}
+		if *splitBy != "conns" && *splitBy != "requests" {
+			fmt.Printf("unknown splitby: %s\n", *splitBy)
+			return
+		}
+		bl.split, err = mct.NewTrafficSplit(bl.servers, pcts)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		bl.splitByRequest = *splitBy == "requests"
+	}
+
+	if *useTLS {
+		conf, err := mct.NewTLSConfig(mct.TLSOptions{
+			CAFile:           *tlsCAFile,
+			CertFile:         *tlsCert,
+			KeyFile:          *tlsKey,
+			ServerName:       *tlsServerName,
+			SkipVerify:       *tlsSkipVerify,
+			SessionCacheSize: *tlsSessionCache,
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		bl.tlsConfig = conf
 	}
 
 	if *cpuprofile != "" {
@@ -127,6 +189,12 @@ type BasicLoader struct {
 	zipfV                 float64 // v (< keySpace) puts the main part of the curve before this number
 	valueSize             uint
 	clientFlags           uint
+	username              string
+	password              string
+	tlsConfig             *tls.Config
+	selector              mct.ServerSelector
+	split                 *mct.TrafficSplit
+	splitByRequest        bool
 }
 
 func (l *BasicLoader) Run() {
@@ -157,13 +225,19 @@ func (l *BasicLoader) Timer(tag string, start time.Time) {
 	}
 }
 
+func (l *BasicLoader) newClient(host string) *mct.Client {
+	mc := mct.NewClient(host, l.socket, l.pipelines, l.keyPrefix, l.stripKeyPrefix)
+	mc.AuthUsername = l.username
+	mc.AuthPassword = l.password
+	mc.TLSConfig = l.tlsConfig
+	return mc
+}
+
 // TODO: use sync.Pool for Item/etc?
 // pool.Put() items back before sleep.
 // may also be able to cache mc's bufio's this way.
 func (l *BasicLoader) Worker(doneChan chan<- int) {
-	// FIXME: selector.
-	host := l.servers[0]
-	mc := mct.NewClient(host, l.socket, l.pipelines, l.keyPrefix, l.stripKeyPrefix)
+	mcs := mct.NewMultiClient(l.selector, l.newClient)
 	bundles := l.requestBundlesPerConn
 
 	rs := pcgr.New(time.Now().UnixNano(), 0)
@@ -178,6 +252,11 @@ func (l *BasicLoader) Worker(doneChan chan<- int) {
 	}
 
 	subRS := pcgr.New(1, 0) // randomizer is re-seeded for random strings.
+	// server this worker sticks to, when splitting by conns.
+	conn := 0
+	if l.split != nil {
+		conn = l.split.Pick(randR.Intn(100))
+	}
 	var res int
 	defer func() { doneChan <- res }()
 
@@ -203,6 +282,14 @@ func (l *BasicLoader) Worker(doneChan chan<- int) {
 			}
 
 			key := mct.RandString(&subRS, l.keyLength, l.keyPrefix)
+			mc := mcs.ClientFor(key)
+			if l.split != nil {
+				if l.splitByRequest {
+					mc = mcs.Clients()[l.split.Pick(randR.Intn(100))]
+				} else {
+					mc = mcs.Clients()[conn]
+				}
+			}
 			// chance we issue a delete instead.
 			delChance := randR.Intn(1000)
 			if l.deletePercent != 0 && delChance < l.deletePercent {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"time"
@@ -29,7 +30,29 @@ type BasicLoader struct {
 	ZipfV                 float64       `json:"zipfV"` // v (< KeySpace) puts the main part of the curve before this number
 	ValueSize             uint          `json:"valuesize"`
 	ClientFlags           uint          `json:"clientflags"`
-	stopAfter             time.Time
+	Username              string        `json:"username"`
+	Password              string        `json:"password"`
+	TLS                   bool          `json:"tls"`
+	TLSCAFile             string        `json:"tlscafile"`
+	TLSCertFile           string        `json:"tlscert"`
+	TLSKeyFile            string        `json:"tlskey"`
+	TLSServerName         string        `json:"tlsservername"`
+	TLSSkipVerify         bool          `json:"tlsskipverify"`
+	TLSSessionCache       int           `json:"tlssessioncache"`
+	Selector              string        `json:"selector"`   // modulo, crc32 or ketama
+	ServerPercents        []int         `json:"serverpcts"` // split traffic by percentage instead of key
+	SplitBy               string        `json:"splitby"`    // conns or requests
+	// With a pool, conncount is the number of goroutines sharing poolsize
+	// connections per server.
+	PoolSize            int           `json:"poolsize"`
+	PoolMaxIdle         int           `json:"poolmaxidle"`
+	PoolMaxLifetime     time.Duration `json:"poolmaxlifetime"`
+	PoolHealthCheckIdle time.Duration `json:"poolhealthcheckidle"`
+	stopAfter           time.Time
+	tlsConfig           *tls.Config
+	selector            mct.ServerSelector
+	split               *mct.TrafficSplit
+	pool                *mct.Pool
 }
 
 func newBasicLoader() *BasicLoader {
@@ -52,12 +75,46 @@ func newBasicLoader() *BasicLoader {
 		ZipfV:                 500,
 		ValueSize:             1000,
 		ClientFlags:           0,
+		Selector:              "modulo",
+		SplitBy:               "conns",
 	}
 }
 
+// setup checks settings and builds the server selector, traffic split and
+// TLS config shared by all workers. Sharing the TLS config shares its
+// session cache. Called before the loader is started or updated.
+func (l *BasicLoader) setup() (err error) {
+	l.selector, err = mct.NewSelector(l.Selector, l.Servers, nil)
+	if err != nil {
+		return err
+	}
+	if l.ServerPercents != nil {
+		if l.SplitBy != "conns" && l.SplitBy != "requests" {
+			return fmt.Errorf("unknown splitby: %s", l.SplitBy)
+		}
+		l.split, err = mct.NewTrafficSplit(l.Servers, l.ServerPercents)
+		if err != nil {
+			return err
+		}
+	}
+	if !l.TLS {
+		return nil
+	}
+	l.tlsConfig, err = mct.NewTLSConfig(mct.TLSOptions{
+		CAFile:           l.TLSCAFile,
+		CertFile:         l.TLSCertFile,
+		KeyFile:          l.TLSKeyFile,
+		ServerName:       l.TLSServerName,
+		SkipVerify:       l.TLSSkipVerify,
+		SessionCacheSize: l.TLSSessionCache,
+	})
+	return err
+}
+
 // Update receives *BasicLoader's from the server.
 func runBasicLoader(Update <-chan interface{}, worker interface{}) {
 	var l *BasicLoader = worker.(*BasicLoader)
+	l.startPool()
 	runners := 0
 	nextId := 1
 	workers := make(map[int]chan *BasicLoader)
@@ -88,7 +145,12 @@ func runBasicLoader(Update <-chan interface{}, worker interface{}) {
 		case update, ok := <-Update:
 			if ok {
 				fmt.Printf("received basic loader update\n")
+				// Workers give connections back to the pool they took
+				// them from, which closes them once it's closed. Workers
+				// finding the pool closed mid-bundle wait for the update.
+				l.stopPool()
 				l = update.(*BasicLoader)
+				l.startPool()
 				// Blast out update to everyone.
 				// Note they will pick up changes during the next sleep cycle.
 				for _, wc := range workers {
@@ -112,18 +174,106 @@ func runBasicLoader(Update <-chan interface{}, worker interface{}) {
 				delete(workers, id)
 				runners--
 			}
+			l.stopPool()
 			return
 		}
 	}
 }
 
+// pickConn picks the server a worker sticks to when splitting by conns.
+func (l *BasicLoader) pickConn(randR *rand.Rand) int {
+	if l.split == nil || l.SplitBy != "conns" {
+		return 0
+	}
+	return l.split.Pick(randR.Intn(100))
+}
+
+// serverFor picks the server index for a request: by key hash, unless
+// traffic is split by percentage, where it's either the worker's server or
+// a fresh pick per request.
+func (l *BasicLoader) serverFor(key string, conn int, randR *rand.Rand) int {
+	switch {
+	case l.split == nil:
+		return l.selector.Pick(key)
+	case l.SplitBy == "requests":
+		return l.split.Pick(randR.Intn(100))
+	}
+	return conn
+}
+
+// request issues a get, setting the value on a miss, or sometimes a delete
+// instead.
+func (l *BasicLoader) request(mc *mct.Client, key string, randR *rand.Rand, rs rand.Source) error {
+	// chance we issue a delete instead.
+	if l.DeletePercent != 0 && randR.Intn(1000) < l.DeletePercent {
+		_, err := mc.Delete(key)
+		return err
+	}
+	// issue gets
+	_, _, code, err := mc.Get(key)
+	// validate responses
+	if err != nil {
+		return err
+	}
+	// set missing values
+	if code == mct.McMISS {
+		// TODO: random sizing
+		value := mct.RandBytes(rs, int(l.ValueSize))
+		mc.Set(key, uint32(l.ClientFlags), uint32(l.KeyTTL), value)
+	}
+	return nil
+}
+
+// startPool sets up the connection pool shared by all workers, if asked for.
+func (l *BasicLoader) startPool() {
+	if l.PoolSize == 0 {
+		return
+	}
+	l.pool = mct.NewPool(l.selector, l.newClient, mct.PoolOptions{
+		Size:            l.PoolSize,
+		MaxIdle:         l.PoolMaxIdle,
+		MaxLifetime:     l.PoolMaxLifetime,
+		HealthCheckIdle: l.PoolHealthCheckIdle,
+	})
+}
+
+func (l *BasicLoader) stopPool() {
+	if l.pool != nil {
+		l.pool.Close()
+	}
+}
+
+func (l *BasicLoader) newClient(host string) *mct.Client {
+	mc := mct.NewClient(host, l.Socket, l.Pipelines, l.KeyPrefix, l.StripKeyPrefix)
+	mc.AuthUsername = l.Username
+	mc.AuthPassword = l.Password
+	mc.TLSConfig = l.tlsConfig
+	return mc
+}
+
+// sameConnSettings is true if clients built by l would be set up the same
+// as ones built by o, so connections can be kept across an update.
+func (l *BasicLoader) sameConnSettings(o *BasicLoader) bool {
+	return l.Socket == o.Socket &&
+		l.Pipelines == o.Pipelines &&
+		l.KeyPrefix == o.KeyPrefix &&
+		l.StripKeyPrefix == o.StripKeyPrefix &&
+		l.Username == o.Username &&
+		l.Password == o.Password &&
+		l.TLS == o.TLS &&
+		l.TLSCAFile == o.TLSCAFile &&
+		l.TLSCertFile == o.TLSCertFile &&
+		l.TLSKeyFile == o.TLSKeyFile &&
+		l.TLSServerName == o.TLSServerName &&
+		l.TLSSkipVerify == o.TLSSkipVerify &&
+		l.TLSSessionCache == o.TLSSessionCache
+}
+
 // TODO: use sync.Pool for Item/etc?
 // pool.Put() items back before sleep.
 // may also be able to cache mc's bufio's this way.
 func basicWorker(id int, doneChan chan<- int, updateChan <-chan *BasicLoader, l *BasicLoader) {
-	// TODO: server selector.
-	host := l.Servers[0]
-	mc := mct.NewClient(host, l.Socket, l.Pipelines, l.KeyPrefix, l.StripKeyPrefix)
+	mcs := mct.NewMultiClient(l.selector, l.newClient)
 	bundles := l.RequestBundlesPerConn
 
 	rs := pcgr.New(time.Now().UnixNano(), 0)
@@ -138,6 +288,19 @@ func basicWorker(id int, doneChan chan<- int, updateChan <-chan *BasicLoader, l
 	}
 
 	subRS := pcgr.New(1, 0) // randomizer is re-seeded for random strings.
+	conn := l.pickConn(randR)
+	switchTo := func(update *BasicLoader) {
+		if l.sameConnSettings(update) {
+			// Clients for servers still in the list keep their
+			// connections.
+			mcs.SetSelector(update.selector, nil)
+		} else {
+			mcs.SetSelector(update.selector, update.newClient)
+		}
+		l = update
+		// Percentages may have moved; conns pick again.
+		conn = l.pickConn(randR)
+	}
 	// TODO: struct with id, res, err?
 	defer func() {
 		doneChan <- id
@@ -163,34 +326,39 @@ func basicWorker(id int, doneChan chan<- int, updateChan <-chan *BasicLoader, l
 			}
 
 			key := mct.RandString(&subRS, l.KeyLength, l.KeyPrefix)
-			// chance we issue a delete instead.
-			if l.DeletePercent != 0 && randR.Intn(1000) < l.DeletePercent {
-				_, err := mc.Delete(key)
-				if err != nil {
-					fmt.Println(err)
-					return
+			server := l.serverFor(key, conn, randR)
+			var err error
+			if pool := l.pool; pool != nil {
+				// Like an app server: borrow a connection per request.
+				mc, cerr := pool.Checkout(l.Servers[server])
+				if cerr == mct.ErrPoolClosed {
+					// The loader was updated mid-bundle and its pool
+					// closed; the update is already on its way.
+					update, ok := <-updateChan
+					if !ok {
+						return
+					}
+					switchTo(update)
+					continue
 				}
-			} else {
-				// issue gets
-				_, _, code, err := mc.Get(key)
-				// validate responses
-				if err != nil {
-					fmt.Println(err)
+				if cerr != nil {
+					fmt.Println(cerr)
 					return
 				}
-				// set missing values
-				if code == mct.McMISS {
-					// TODO: random sizing
-					value := mct.RandBytes(&rs, int(l.ValueSize))
-					mc.Set(key, uint32(l.ClientFlags), uint32(l.KeyTTL), value)
-				}
+				err = l.request(mc, key, randR, &rs)
+				pool.Return(mc)
+			} else {
+				err = l.request(mcs.Clients()[server], key, randR, &rs)
+			}
+			if err != nil {
+				fmt.Println(err)
+				return
 			}
 		}
 		select {
 		case update, ok := <-updateChan:
-			// TODO: re-create client if server changed.
 			if ok {
-				l = update
+				switchTo(update)
 			} else {
 				// Told to die. Let the deferral handle updating doneChan.
 				return
@@ -261,6 +261,10 @@ func setHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if err := t.setup(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		l := Loader{Name: wrap.Name, LType: wrap.LType, Worker: t}
 		updateChan <- &l
 	default:
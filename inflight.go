@@ -0,0 +1,272 @@
+// In-flight meta request tracking, for matching pipelined responses back
+// to requests by opaque, and the quiet mode batch driver built on it.
+
+package mctester
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnknownOpaque = errors.New("response opaque does not match an in-flight request")
+	ErrOutOfOrder    = errors.New("response skipped an in-flight request that was not quiet")
+	ErrNoInflight    = errors.New("response received with no requests in flight")
+	ErrInflight      = errors.New("requests already in flight")
+	ErrBadBatch      = errors.New("bad request in meta batch")
+)
+
+// MetaRequest is a queued meta request as tracked by AutoOpaque.
+type MetaRequest struct {
+	Cmd    string // mg, ms, md, ma, mn, me
+	Key    string
+	Opaque uint32 // 0 for mn and me, which take no opaque
+	Quiet  bool
+}
+
+// hasQuietFlag looks for a bare q token in a raw flag string.
+func hasQuietFlag(flags string) bool {
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == 'q' && (i == 0 || flags[i-1] == ' ') &&
+			(i == len(flags)-1 || flags[i+1] == ' ') {
+			return true
+		}
+	}
+	return false
+}
+
+// metaFlags checks f for cmd and makes way for the client assigned opaque
+// when AutoOpaque is set.
+func (c *Client) metaFlags(f MetaFlags, cmd metaCmd) (MetaFlags, error) {
+	if err := f.validate(cmd); err != nil {
+		return f, err
+	}
+	if c.AutoOpaque {
+		// Client assigned opaques take over.
+		f.set &^= 1 << mfOpaque
+	}
+	return f, nil
+}
+
+// trackMeta tags the request being written with the next opaque.
+// Must be called before the request's trailing \r\n.
+func (c *Client) trackMeta(cmd string, key string, quiet bool) {
+	if !c.AutoOpaque {
+		return
+	}
+	req := MetaRequest{Cmd: cmd, Key: key, Quiet: quiet}
+	// mn takes no flags.
+	if cmd != "mn" {
+		c.opaque++
+		req.Opaque = c.opaque
+		b := c.cn.b
+		b.WriteString(" O")
+		writeUint(b.Writer, uint64(req.Opaque))
+	}
+	c.pushInflight(req)
+}
+
+func (c *Client) pushInflight(req MetaRequest) {
+	// A steady pipeline never empties the queue, so shift the live requests
+	// back to the front once the popped ones make up most of the slice.
+	if c.inflightHead != 0 && c.inflightHead >= len(c.inflight)/2 {
+		n := copy(c.inflight, c.inflight[c.inflightHead:])
+		c.inflight = c.inflight[:n]
+		c.inflightHead = 0
+	}
+	c.inflight = append(c.inflight, req)
+}
+
+// popInflight removes the oldest request. Must not be called when empty.
+func (c *Client) popInflight() MetaRequest {
+	req := c.inflight[c.inflightHead]
+	c.inflightHead++
+	if c.inflightHead == len(c.inflight) {
+		// Empty; rewind to reuse the slice.
+		c.inflight = c.inflight[:0]
+		c.inflightHead = 0
+	}
+	return req
+}
+
+// MetaInflight returns the number of tracked requests awaiting a response.
+func (c *Client) MetaInflight() int {
+	return len(c.inflight) - c.inflightHead
+}
+
+// matchInflight finds the request for a response and fills in r.Request.
+// Quiet requests ahead of the match had their response suppressed, which
+// means they succeeded, and are dropped. Skipping past a request that isn't
+// quiet means a response went missing or came back out of order.
+func (c *Client) matchInflight(r *MetaResponse) error {
+	if c.MetaInflight() == 0 {
+		return ErrNoInflight
+	}
+
+	var match func(req *MetaRequest) bool
+	switch {
+	case r.Code == McMN:
+		match = func(req *MetaRequest) bool { return req.Cmd == "mn" }
+	case r.Opaque != nil:
+		opaque, err := parseMetaUint(r.Opaque)
+		if err != nil {
+			return ErrUnknownOpaque
+		}
+		match = func(req *MetaRequest) bool { return uint64(req.Opaque) == opaque }
+	default:
+		// No opaque to go on (me, or an error line); has to be the oldest
+		// request.
+		r.Request = c.popInflight()
+		return nil
+	}
+
+	found := false
+	for i := c.inflightHead; i < len(c.inflight); i++ {
+		if match(&c.inflight[i]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrUnknownOpaque
+	}
+
+	var err error
+	for {
+		req := c.popInflight()
+		if match(&req) {
+			r.Request = req
+			break
+		}
+		if !req.Quiet {
+			err = ErrOutOfOrder
+		} else if c.collectSuppressed {
+			c.suppressed = append(c.suppressed, req)
+		}
+	}
+	return err
+}
+
+// resetInflight forgets everything in flight, ie; after an error leaves
+// the response stream in an unknown state.
+func (c *Client) resetInflight() {
+	c.inflight = c.inflight[:0]
+	c.inflightHead = 0
+}
+
+// MetaBatchRequest is one request for MetaQuietBatch. Cmd is one of mg, ms,
+// md or ma. Value is only used by ms, Arith only by ma.
+type MetaBatchRequest struct {
+	Cmd   string
+	Key   string
+	Flags MetaFlags
+	Value []byte
+	Arith *MetaArith
+}
+
+// MetaBatchResult holds the outcome of a MetaQuietBatch.
+type MetaBatchResult struct {
+	// Responses the server didn't suppress: hits for mg, failures for the
+	// rest.
+	Responses []MetaResponse
+	// Suppressed requests got no response: a miss for mg, a success for ms,
+	// md and ma.
+	Suppressed []MetaRequest
+}
+
+// MetaQuietBatch sends every request in quiet mode followed by an mn, then
+// reads back responses until the MN. This is the usual multiget and bulk
+// set pattern. Requests are tagged with opaques whether or not AutoOpaque
+// is set, so every response is checked against its request.
+func (c *Client) MetaQuietBatch(reqs []MetaBatchRequest) (res *MetaBatchResult, err error) {
+	if c.MetaInflight() != 0 {
+		return nil, ErrInflight
+	}
+	// Check the whole batch before anything is queued.
+	for i := range reqs {
+		req := &reqs[i]
+		if len(req.Key) > 250 {
+			return nil, ErrKeyTooLong
+		}
+		var cmd metaCmd
+		switch req.Cmd {
+		case "mg":
+			cmd = metaCmdGet
+		case "ms":
+			cmd = metaCmdSet
+		case "md":
+			cmd = metaCmdDelete
+		case "ma":
+			if req.Arith == nil {
+				return nil, ErrBadBatch
+			}
+			cmd = metaCmdArith
+		default:
+			return nil, ErrBadBatch
+		}
+		if err := req.Flags.validate(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	autoOpaque := c.AutoOpaque
+	c.AutoOpaque = true
+	c.collectSuppressed = true
+	c.suppressed = c.suppressed[:0]
+	defer func() {
+		c.AutoOpaque = autoOpaque
+		c.collectSuppressed = false
+		if err != nil {
+			c.resetInflight()
+		}
+	}()
+
+	for i := range reqs {
+		req := &reqs[i]
+		f := req.Flags.Quiet()
+		switch req.Cmd {
+		case "mg":
+			err = c.MetaGetFlags(req.Key, f)
+		case "ms":
+			err = c.MetaSetFlags(req.Key, f, req.Value)
+		case "md":
+			err = c.MetaDeleteFlags(req.Key, f)
+		case "ma":
+			err = c.MetaArithmeticFlags(req.Key, req.Arith, f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = c.MetaNoop(); err != nil {
+		return nil, err
+	}
+
+	res = &MetaBatchResult{}
+	var mismatch error
+	for {
+		var r MetaResponse
+		if err = c.MetaReceiveInto(&r); err != nil {
+			// Connection errors are already dropped. Anything else means
+			// responses no longer line up with requests, and the rest of
+			// them are still unread.
+			c.dropConn()
+			return nil, err
+		}
+		if r.Code == McMN {
+			break
+		}
+		if r.Key != nil && string(r.Key) != r.Request.Key {
+			// Keep reading to MN so the connection stays usable.
+			mismatch = ErrKeyDoesNotMatch
+			continue
+		}
+		res.Responses = append(res.Responses, r)
+	}
+	if mismatch != nil {
+		err = mismatch
+		return nil, err
+	}
+	res.Suppressed = append(res.Suppressed, c.suppressed...)
+
+	return res, nil
+}
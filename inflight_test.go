@@ -0,0 +1,207 @@
+package mctester
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHasQuietFlag(t *testing.T) {
+	tests := map[string]bool{
+		"":        false,
+		"q":       true,
+		"v q":     true,
+		"q v":     true,
+		"v q t":   true,
+		"v Oq":    false,
+		"qv":      false,
+		"k v T30": false,
+	}
+	for flags, quiet := range tests {
+		if hasQuietFlag(flags) != quiet {
+			t.Fatalf("%q: expected quiet %v", flags, quiet)
+		}
+	}
+}
+
+func TestMetaAutoOpaque(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"mg foo v O1\r\n", "VA 3 O1\r\nbar\r\n",
+		"ms foo 3 T30 O2\r\nbar\r\n", "HD O2\r\n",
+		"md foo O3\r\n", "NF O3\r\n",
+		// quiet requests: only the second get misses, so is suppressed.
+		"mg one v q O4\r\n", "VA 1 O4\r\n1\r\n",
+		"mg two v q O5\r\n", "",
+		"mg three v q O6\r\n", "VA 1 O6\r\n3\r\n",
+		"mn\r\n", "MN\r\n",
+	))
+	mc.AutoOpaque = true
+
+	r := &MetaResponse{}
+	mc.MetaGet("foo", "v")
+	if err := mc.MetaReceiveInto(r); err != nil {
+		t.Fatalf("metareceive error: %v", err)
+	}
+	if r.Request.Cmd != "mg" || r.Request.Key != "foo" || r.Request.Opaque != 1 {
+		t.Fatalf("bad request for response: %+v", r.Request)
+	}
+
+	mc.MetaSetFlags("foo", MetaFlags{}.WithTTL(30).WithOpaque(99), []byte("bar"))
+	mc.MetaDeleteFlags("foo", MetaFlags{})
+	if err := mc.MetaReceiveInto(r); err != nil || r.Request.Cmd != "ms" {
+		t.Fatalf("bad set response: %+v %v", r.Request, err)
+	}
+	if err := mc.MetaReceiveInto(r); err != nil || r.Request.Cmd != "md" || r.Code != McNF {
+		t.Fatalf("bad delete response: %+v %v", r.Request, err)
+	}
+
+	mc.MetaGet("one", "v q")
+	mc.MetaGet("two", "v q")
+	mc.MetaGet("three", "v q")
+	mc.MetaNoop()
+	if mc.MetaInflight() != 4 {
+		t.Fatalf("expected 4 requests in flight, got %d", mc.MetaInflight())
+	}
+	for _, key := range []string{"one", "three"} {
+		if err := mc.MetaReceiveInto(r); err != nil || r.Request.Key != key {
+			t.Fatalf("expected response for %s: %+v %v", key, r.Request, err)
+		}
+	}
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McMN || r.Request.Cmd != "mn" {
+		t.Fatalf("bad noop response: %d %+v %v", r.Code, r.Request, err)
+	}
+	if mc.MetaInflight() != 0 {
+		t.Fatalf("expected nothing in flight, got %d", mc.MetaInflight())
+	}
+}
+
+func TestInflightSteadyPipeline(t *testing.T) {
+	c := &Client{}
+	c.pushInflight(MetaRequest{Opaque: 0})
+	for i := 1; i <= 10000; i++ {
+		c.pushInflight(MetaRequest{Opaque: uint32(i)})
+		if req := c.popInflight(); req.Opaque != uint32(i-1) {
+			t.Fatalf("expected opaque %d, got %d", i-1, req.Opaque)
+		}
+	}
+	if c.MetaInflight() != 1 || len(c.inflight) > 2 {
+		t.Fatalf("queue grew with one request in flight: len %d head %d",
+			len(c.inflight), c.inflightHead)
+	}
+}
+
+func TestMetaAutoOpaqueErrors(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"mg foo v O1\r\n", "",
+		"mg bar v O2\r\n", "EN O2\r\n",
+		"mg baz v O3\r\n", "HD O9\r\n",
+	))
+	mc.AutoOpaque = true
+
+	r := &MetaResponse{}
+	mc.MetaGet("foo", "v")
+	mc.MetaGet("bar", "v")
+	if err := mc.MetaReceiveInto(r); err != ErrOutOfOrder {
+		t.Fatalf("expected out of order error, got: %v", err)
+	}
+	if r.Request.Key != "bar" {
+		t.Fatalf("expected response matched to bar, got: %+v", r.Request)
+	}
+
+	mc.MetaGet("baz", "v")
+	if err := mc.MetaReceiveInto(r); err != ErrUnknownOpaque {
+		t.Fatalf("expected unknown opaque error, got: %v", err)
+	}
+}
+
+func TestMetaQuietBatch(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"ms foo 3 q T30 O1\r\nbar\r\n", "",
+		"ms baz 3 q ME O2\r\nbaz\r\n", "NS O2\r\n",
+		"mg foo k q v O3\r\n", "VA 3 kfoo O3\r\nbar\r\n",
+		"mg nope k q v O4\r\n", "",
+		"md gone q O5\r\n", "",
+		"ma cnt MI D1 q O6\r\n", "",
+		"mn\r\n", "MN\r\n",
+	))
+
+	get := MetaFlags{}.WithKey().WithValue()
+	res, err := mc.MetaQuietBatch([]MetaBatchRequest{
+		{Cmd: "ms", Key: "foo", Flags: MetaFlags{}.WithTTL(30), Value: []byte("bar")},
+		{Cmd: "ms", Key: "baz", Flags: MetaFlags{}.SetMode(MetaModeAdd), Value: []byte("baz")},
+		{Cmd: "mg", Key: "foo", Flags: get},
+		{Cmd: "mg", Key: "nope", Flags: get},
+		{Cmd: "md", Key: "gone"},
+		{Cmd: "ma", Key: "cnt", Arith: &MetaArith{Delta: 1}},
+	})
+	if err != nil {
+		t.Fatalf("batch error: %v", err)
+	}
+
+	if len(res.Responses) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(res.Responses))
+	}
+	if r := res.Responses[0]; r.Code != McNS || r.Request.Key != "baz" {
+		t.Fatalf("expected NS for baz, got %d for %s", r.Code, r.Request.Key)
+	}
+	if r := res.Responses[1]; r.Code != McVA || string(r.Value) != "bar" || r.Request.Key != "foo" {
+		t.Fatalf("expected hit for foo, got %d %q for %s", r.Code, r.Value, r.Request.Key)
+	}
+
+	var suppressed []string
+	for _, req := range res.Suppressed {
+		suppressed = append(suppressed, req.Cmd+" "+req.Key)
+	}
+	if strings.Join(suppressed, ",") != "ms foo,mg nope,md gone,ma cnt" {
+		t.Fatalf("bad suppressed list: %v", suppressed)
+	}
+	if mc.AutoOpaque || mc.MetaInflight() != 0 {
+		t.Fatalf("batch left tracking state behind")
+	}
+
+	if _, err := mc.MetaQuietBatch([]MetaBatchRequest{{Cmd: "mx", Key: "foo"}}); err != ErrBadBatch {
+		t.Fatalf("expected bad batch error, got: %v", err)
+	}
+	if _, err := mc.MetaQuietBatch([]MetaBatchRequest{{Cmd: "ma", Key: "foo"}}); err != ErrBadBatch {
+		t.Fatalf("expected bad batch error, got: %v", err)
+	}
+}
+
+// Errors part way through a batch must not leave responses on the wire for
+// the next command to read.
+func TestMetaQuietBatchErrors(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"mg foo k q v O1\r\n", "VA 3 kbar O1\r\nbar\r\n",
+		"mg baz k q v O2\r\n", "VA 3 kbaz O2\r\nbaz\r\n",
+		"mn\r\n", "MN\r\n",
+		"mg foo v\r\n", "VA 3\r\nbar\r\n",
+	))
+	get := MetaFlags{}.WithKey().WithValue()
+	_, err := mc.MetaQuietBatch([]MetaBatchRequest{
+		{Cmd: "mg", Key: "foo", Flags: get},
+		{Cmd: "mg", Key: "baz", Flags: get},
+	})
+	if err != ErrKeyDoesNotMatch {
+		t.Fatalf("expected key mismatch, got: %v", err)
+	}
+	r := &MetaResponse{}
+	mc.MetaGet("foo", "v")
+	if err := mc.MetaReceiveInto(r); err != nil || string(r.Value) != "bar" {
+		t.Fatalf("stale response after mismatch: %q %v", r.Value, err)
+	}
+
+	mc = newcliHost(scriptServer(t,
+		"mg foo q v O1\r\n", "VA 3 O7\r\nbar\r\n",
+		"mg baz q v O2\r\n", "",
+		"mn\r\n", "MN\r\n",
+	))
+	_, err = mc.MetaQuietBatch([]MetaBatchRequest{
+		{Cmd: "mg", Key: "foo", Flags: MetaFlags{}.WithValue()},
+		{Cmd: "mg", Key: "baz", Flags: MetaFlags{}.WithValue()},
+	})
+	if err != ErrUnknownOpaque {
+		t.Fatalf("expected unknown opaque, got: %v", err)
+	}
+	if mc.Connected() {
+		t.Fatalf("expected connection dropped after unknown opaque")
+	}
+}
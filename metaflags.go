@@ -0,0 +1,266 @@
+// Typed meta protocol request flags.
+
+package mctester
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+)
+
+var ErrBadMetaFlag = errors.New("flag not valid for meta command")
+
+// metaCmd is a bitmask of meta commands a flag is valid for.
+type metaCmd uint8
+
+const (
+	metaCmdGet metaCmd = 1 << iota
+	metaCmdSet
+	metaCmdDelete
+	metaCmdArith
+	metaCmdAll = metaCmdGet | metaCmdSet | metaCmdDelete | metaCmdArith
+)
+
+func (m metaCmd) String() string {
+	switch m {
+	case metaCmdGet:
+		return "mg"
+	case metaCmdSet:
+		return "ms"
+	case metaCmdDelete:
+		return "md"
+	case metaCmdArith:
+		return "ma"
+	}
+	return "unknown"
+}
+
+// Bit positions into MetaFlags.set, in the order they're serialized.
+const (
+	mfBase64Key = iota
+	mfReturnCAS
+	mfReturnFlags
+	mfReturnHit
+	mfReturnKey
+	mfReturnLastAccess
+	mfQuiet
+	mfReturnSize
+	mfReturnTTL
+	mfNoBump
+	mfValue
+	mfInvalidate
+	mfOpaque
+	mfTTL
+	mfVivify
+	mfRecache
+	mfCompareCAS
+	mfClientFlags
+	mfMode
+	mfCount
+)
+
+// ma takes vivify and CAS compare through MetaArith instead.
+var metaFlagTable = [mfCount]struct {
+	c    byte
+	cmds metaCmd
+}{
+	mfBase64Key:        {'b', metaCmdAll},
+	mfReturnCAS:        {'c', metaCmdGet | metaCmdSet | metaCmdArith},
+	mfReturnFlags:      {'f', metaCmdGet},
+	mfReturnHit:        {'h', metaCmdGet},
+	mfReturnKey:        {'k', metaCmdAll},
+	mfReturnLastAccess: {'l', metaCmdGet},
+	mfQuiet:            {'q', metaCmdAll},
+	mfReturnSize:       {'s', metaCmdGet},
+	mfReturnTTL:        {'t', metaCmdGet | metaCmdArith},
+	mfNoBump:           {'u', metaCmdGet},
+	mfValue:            {'v', metaCmdGet | metaCmdArith},
+	mfInvalidate:       {'I', metaCmdSet | metaCmdDelete},
+	mfOpaque:           {'O', metaCmdAll},
+	mfTTL:              {'T', metaCmdAll},
+	mfVivify:           {'N', metaCmdGet},
+	mfRecache:          {'R', metaCmdGet},
+	mfCompareCAS:       {'C', metaCmdSet | metaCmdDelete},
+	mfClientFlags:      {'F', metaCmdSet},
+	mfMode:             {'M', metaCmdSet},
+}
+
+// MetaSetMode is the storage mode for ms.
+type MetaSetMode byte
+
+const (
+	MetaModeSet     MetaSetMode = 'S'
+	MetaModeAdd     MetaSetMode = 'E'
+	MetaModeAppend  MetaSetMode = 'A'
+	MetaModePrepend MetaSetMode = 'P'
+	MetaModeReplace MetaSetMode = 'R'
+)
+
+// MetaFlags is a typed set of meta request flags. Methods return a modified
+// copy so they can be chained off a zero value:
+//
+//	f := MetaFlags{}.WithValue().WithCAS().WithTTL(30)
+//
+// Build flags once and reuse them; writing them out does not allocate.
+type MetaFlags struct {
+	set     uint32
+	opaque  uint32
+	ttl     uint32
+	vivify  uint32
+	recache uint32
+	cflags  uint32
+	cas     uint64
+	mode    MetaSetMode
+}
+
+func (f MetaFlags) with(bit int) MetaFlags {
+	f.set |= 1 << bit
+	return f
+}
+
+func (f MetaFlags) has(bit int) bool {
+	return f.set&(1<<bit) != 0
+}
+
+// WithValue returns the item value (v).
+func (f MetaFlags) WithValue() MetaFlags { return f.with(mfValue) }
+
+// WithCAS returns the item CAS (c).
+func (f MetaFlags) WithCAS() MetaFlags { return f.with(mfReturnCAS) }
+
+// WithClientFlags returns the item client flags (f).
+func (f MetaFlags) WithClientFlags() MetaFlags { return f.with(mfReturnFlags) }
+
+// WithHit returns whether the item was fetched before (h).
+func (f MetaFlags) WithHit() MetaFlags { return f.with(mfReturnHit) }
+
+// WithKey returns the key (k).
+func (f MetaFlags) WithKey() MetaFlags { return f.with(mfReturnKey) }
+
+// WithLastAccess returns seconds since last access (l).
+func (f MetaFlags) WithLastAccess() MetaFlags { return f.with(mfReturnLastAccess) }
+
+// WithSize returns the item size (s).
+func (f MetaFlags) WithSize() MetaFlags { return f.with(mfReturnSize) }
+
+// WithRemainingTTL returns the item's remaining TTL (t).
+func (f MetaFlags) WithRemainingTTL() MetaFlags { return f.with(mfReturnTTL) }
+
+// NoBump skips bumping the item in the LRU (u).
+func (f MetaFlags) NoBump() MetaFlags { return f.with(mfNoBump) }
+
+// Quiet suppresses the common response for the command (q).
+func (f MetaFlags) Quiet() MetaFlags { return f.with(mfQuiet) }
+
+// Base64Key marks the key as base64 encoded (b).
+func (f MetaFlags) Base64Key() MetaFlags { return f.with(mfBase64Key) }
+
+// Invalidate marks the item stale instead of removing or replacing it (I).
+func (f MetaFlags) Invalidate() MetaFlags { return f.with(mfInvalidate) }
+
+// WithTTL sets (or on mg, updates) the item TTL (T).
+func (f MetaFlags) WithTTL(ttl uint32) MetaFlags {
+	f.ttl = ttl
+	return f.with(mfTTL)
+}
+
+// WithOpaque sets an opaque token to be echoed back (O).
+func (f MetaFlags) WithOpaque(opaque uint32) MetaFlags {
+	f.opaque = opaque
+	return f.with(mfOpaque)
+}
+
+// Vivify creates a placeholder item with this TTL on miss (N).
+func (f MetaFlags) Vivify(ttl uint32) MetaFlags {
+	f.vivify = ttl
+	return f.with(mfVivify)
+}
+
+// RecacheAt wins the recache flag if the remaining TTL is below ttl (R).
+func (f MetaFlags) RecacheAt(ttl uint32) MetaFlags {
+	f.recache = ttl
+	return f.with(mfRecache)
+}
+
+// CompareCAS only applies the change if the item CAS matches (C).
+func (f MetaFlags) CompareCAS(cas uint64) MetaFlags {
+	f.cas = cas
+	return f.with(mfCompareCAS)
+}
+
+// SetClientFlags sets the client flags stored with the item (F).
+func (f MetaFlags) SetClientFlags(flags uint32) MetaFlags {
+	f.cflags = flags
+	return f.with(mfClientFlags)
+}
+
+// SetMode picks the ms storage mode (M).
+func (f MetaFlags) SetMode(mode MetaSetMode) MetaFlags {
+	f.mode = mode
+	return f.with(mfMode)
+}
+
+// validate checks that every flag is valid for the command.
+func (f MetaFlags) validate(cmd metaCmd) error {
+	for bit := 0; bit < mfCount; bit++ {
+		if f.has(bit) && metaFlagTable[bit].cmds&cmd == 0 {
+			return fmt.Errorf("%w: %c for %s", ErrBadMetaFlag, metaFlagTable[bit].c, cmd)
+		}
+	}
+	if f.has(mfMode) {
+		switch f.mode {
+		case MetaModeSet, MetaModeAdd, MetaModeAppend, MetaModePrepend, MetaModeReplace:
+		default:
+			return fmt.Errorf("%w: mode %c for %s", ErrBadMetaFlag, f.mode, cmd)
+		}
+	}
+	return nil
+}
+
+// Upper bound on the serialized length: a space, a flag byte and up to 20
+// digits per flag.
+const metaFlagsMaxLen = mfCount * 22
+
+// write serializes the flags, each with a leading space.
+func (f *MetaFlags) write(b *bufio.Writer) {
+	for bit := 0; bit < mfCount; bit++ {
+		if !f.has(bit) {
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteByte(metaFlagTable[bit].c)
+		switch bit {
+		case mfOpaque:
+			writeUint(b, uint64(f.opaque))
+		case mfTTL:
+			writeUint(b, uint64(f.ttl))
+		case mfVivify:
+			writeUint(b, uint64(f.vivify))
+		case mfRecache:
+			writeUint(b, uint64(f.recache))
+		case mfCompareCAS:
+			writeUint(b, f.cas)
+		case mfClientFlags:
+			writeUint(b, uint64(f.cflags))
+		case mfMode:
+			b.WriteByte(byte(f.mode))
+		}
+	}
+}
+
+// writeUint writes a number without going through a heap allocated string.
+func writeUint(b *bufio.Writer, n uint64) {
+	var buf [20]byte
+	i := len(buf)
+	for {
+		i--
+		buf[i] = byte('0' + n%10)
+		n /= 10
+		if n == 0 {
+			break
+		}
+	}
+	for ; i < len(buf); i++ {
+		b.WriteByte(buf[i])
+	}
+}
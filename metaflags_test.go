@@ -0,0 +1,110 @@
+package mctester
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMetaFlagsWrite(t *testing.T) {
+	tests := []struct {
+		f   MetaFlags
+		out string
+	}{
+		{MetaFlags{}, ""},
+		{MetaFlags{}.WithValue(), " v"},
+		{MetaFlags{}.WithTTL(30).WithValue().WithCAS(), " c v T30"},
+		{MetaFlags{}.Quiet().WithOpaque(7).Base64Key().WithKey(), " b k q O7"},
+		{MetaFlags{}.Vivify(30).RecacheAt(10).WithRemainingTTL(), " t N30 R10"},
+		{MetaFlags{}.SetMode(MetaModeAppend).Invalidate().SetClientFlags(5).CompareCAS(123), " I C123 F5 MA"},
+		{MetaFlags{}.WithTTL(0), " T0"},
+	}
+
+	var out bytes.Buffer
+	b := bufio.NewWriter(&out)
+	for _, tt := range tests {
+		out.Reset()
+		tt.f.write(b)
+		b.Flush()
+		if out.String() != tt.out {
+			t.Fatalf("expected %q, got %q", tt.out, out.String())
+		}
+	}
+}
+
+func TestMetaFlagsValidate(t *testing.T) {
+	tests := []struct {
+		f   MetaFlags
+		cmd metaCmd
+		ok  bool
+	}{
+		{MetaFlags{}.WithValue().WithCAS().Vivify(30).RecacheAt(5), metaCmdGet, true},
+		{MetaFlags{}.WithValue(), metaCmdSet, false},
+		{MetaFlags{}.SetMode(MetaModeAdd).CompareCAS(5), metaCmdSet, true},
+		{MetaFlags{}.SetMode(MetaModeAdd), metaCmdGet, false},
+		{MetaFlags{}.SetMode('Q'), metaCmdSet, false},
+		{MetaFlags{}.Invalidate().WithTTL(30).Quiet(), metaCmdDelete, true},
+		{MetaFlags{}.Invalidate(), metaCmdGet, false},
+		{MetaFlags{}.WithValue().WithCAS().WithRemainingTTL(), metaCmdArith, true},
+		{MetaFlags{}.Vivify(30), metaCmdArith, false},
+	}
+
+	for i, tt := range tests {
+		err := tt.f.validate(tt.cmd)
+		if tt.ok && err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		} else if !tt.ok && !errors.Is(err, ErrBadMetaFlag) {
+			t.Fatalf("%d: expected ErrBadMetaFlag, got: %v", i, err)
+		}
+	}
+}
+
+func TestMetaFlagsWriteAllocs(t *testing.T) {
+	b := bufio.NewWriter(io.Discard)
+	f := MetaFlags{}.WithValue().WithCAS().WithTTL(300).WithOpaque(12345).CompareCAS(1 << 60)
+	allocs := testing.AllocsPerRun(100, func() {
+		f.write(b)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected zero allocations, got %f", allocs)
+	}
+}
+
+func TestMetaFlagsClient(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"ms foo 3 T60 MS\r\nbar\r\n", "HD\r\n",
+		"mg foo c f v\r\n", "VA 3 c5 f0\r\nbar\r\n",
+		"md foo q C5\r\n", "",
+		"ma cnt MI D1 v\r\n", "VA 1\r\n1\r\n",
+		"mn\r\n", "MN\r\n",
+	))
+
+	r := &MetaResponse{}
+	if err := mc.MetaSetFlags("foo", MetaFlags{}.WithTTL(60).SetMode(MetaModeSet), []byte("bar")); err != nil {
+		t.Fatalf("metasetflags error: %v", err)
+	}
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McHD {
+		t.Fatalf("bad set response: %d %v", r.Code, err)
+	}
+
+	mc.MetaGetFlags("foo", MetaFlags{}.WithValue().WithCAS().WithClientFlags())
+	if err := mc.MetaReceiveInto(r); err != nil || string(r.Value) != "bar" || r.CAS != 5 {
+		t.Fatalf("bad get response: %+v %v", r, err)
+	}
+
+	if err := mc.MetaGetFlags("foo", MetaFlags{}.SetMode(MetaModeAdd)); !errors.Is(err, ErrBadMetaFlag) {
+		t.Fatalf("expected bad flag error, got: %v", err)
+	}
+
+	mc.MetaDeleteFlags("foo", MetaFlags{}.Quiet().CompareCAS(5))
+	mc.MetaArithmeticFlags("cnt", &MetaArith{Delta: 1}, MetaFlags{}.WithValue())
+	mc.MetaNoop()
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McVA {
+		t.Fatalf("bad arithmetic response: %d %v", r.Code, err)
+	}
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McMN {
+		t.Fatalf("bad noop response: %d %v", r.Code, err)
+	}
+}
@@ -0,0 +1,125 @@
+// Client routing keys across several servers.
+
+package mctester
+
+// MultiClient holds a Client per server and sends each key to the server
+// its selector picks. Like Client, it's not safe for concurrent use.
+type MultiClient struct {
+	sel       ServerSelector
+	clients   []*Client
+	newClient func(host string) *Client
+}
+
+// NewMultiClient routes keys with sel. newClient makes the Client for each
+// server, so timeouts, auth and TLS can be set up as for a single Client.
+func NewMultiClient(sel ServerSelector, newClient func(host string) *Client) *MultiClient {
+	m := &MultiClient{}
+	m.SetSelector(sel, newClient)
+	return m
+}
+
+// SetSelector switches to a new server list, ie; to add or remove a node.
+// With a nil newClient, clients for servers in both lists are kept along
+// with their connections and the rest are closed. A non-nil newClient
+// replaces the old one and every client is rebuilt with it, for when
+// connection settings have changed.
+func (m *MultiClient) SetSelector(sel ServerSelector, newClient func(host string) *Client) {
+	old := make(map[string]*Client, len(m.clients))
+	for _, c := range m.clients {
+		old[c.Host] = c
+	}
+	if newClient != nil {
+		m.newClient = newClient
+		for _, c := range old {
+			c.Close()
+		}
+		old = nil
+	}
+	servers := sel.Servers()
+	clients := make([]*Client, len(servers))
+	for i, host := range servers {
+		if c, ok := old[host]; ok {
+			clients[i] = c
+			delete(old, host)
+		} else {
+			clients[i] = m.newClient(host)
+		}
+	}
+	for _, c := range old {
+		c.Close()
+	}
+	m.sel = sel
+	m.clients = clients
+}
+
+// Selector returns the current selector.
+func (m *MultiClient) Selector() ServerSelector {
+	return m.sel
+}
+
+// ClientFor returns the Client for the server owning key, for commands
+// MultiClient doesn't wrap.
+func (m *MultiClient) ClientFor(key string) *Client {
+	return m.clients[m.sel.Pick(key)]
+}
+
+// Clients returns the client for each server, in selector order.
+func (m *MultiClient) Clients() []*Client {
+	return m.clients
+}
+
+// Close closes every server connection.
+func (m *MultiClient) Close() error {
+	var err error
+	for _, c := range m.clients {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (m *MultiClient) Get(key string) (flags uint64, value []byte, code McCode, err error) {
+	return m.ClientFor(key).Get(key)
+}
+
+func (m *MultiClient) Set(key string, flags uint32, expiration uint32, value []byte) (code McCode, err error) {
+	return m.ClientFor(key).Set(key, flags, expiration, value)
+}
+
+func (m *MultiClient) Delete(key string) (code McCode, err error) {
+	return m.ClientFor(key).Delete(key)
+}
+
+func (m *MultiClient) Touch(key string, expiration uint32) (code McCode, err error) {
+	return m.ClientFor(key).Touch(key, expiration)
+}
+
+// GetMulti splits keys up by server and does a multiget on each in turn.
+// Results line up with keys, as with Client.GetMulti.
+func (m *MultiClient) GetMulti(keys []string) (results []GetResult, err error) {
+	byServer := make([][]int, len(m.clients))
+	for i, key := range keys {
+		s := m.sel.Pick(key)
+		byServer[s] = append(byServer[s], i)
+	}
+	results = make([]GetResult, len(keys))
+	batch := make([]string, 0, len(keys))
+	for s, idx := range byServer {
+		if len(idx) == 0 {
+			continue
+		}
+		batch = batch[:0]
+		for _, i := range idx {
+			batch = append(batch, keys[i])
+		}
+		res, err := m.clients[s].GetMulti(batch)
+		if err != nil {
+			return nil, err
+		}
+		for n, i := range idx {
+			results[i] = res[n]
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,301 @@
+// Connection pool, for many goroutines sharing a fixed set of connections
+// the way an app server would.
+
+package mctester
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolClosed  = errors.New("pool is closed")
+	ErrPoolTimeout = errors.New("timed out waiting for a pooled connection")
+)
+
+// PoolOptions limits a Pool. Zero values mean no limit.
+type PoolOptions struct {
+	// Connections per server, idle or checked out. Checkout waits for one
+	// to be returned past this.
+	Size int
+	// How long Checkout waits when the server is at Size.
+	WaitTimeout time.Duration
+	// Idle connections kept per server; the rest are closed on return.
+	MaxIdle int
+	// Connections older than this are closed instead of reused.
+	MaxLifetime time.Duration
+	// Idle connections unused for this long are checked with HealthCheck
+	// before being handed out.
+	HealthCheckIdle time.Duration
+	// Defaults to a version command.
+	HealthCheck func(c *Client) error
+}
+
+// PoolStats counts pool events across all servers.
+type PoolStats struct {
+	Opened         uint64
+	Closed         uint64
+	Idle           int
+	InUse          int
+	WaitTimeouts   uint64
+	HealthFailures uint64
+}
+
+type poolEntry struct {
+	c        *Client
+	sp       *serverPool
+	created  time.Time
+	lastUsed time.Time
+}
+
+type serverPool struct {
+	idle []*poolEntry // most recently returned last
+	// connections open or being opened, checked against Size.
+	open int
+	// Checkouts waiting at Size, oldest first. Each is sent a returned
+	// connection, already marked in use, or nil for room to open one.
+	waiters []chan *poolEntry
+}
+
+// Pool hands out Clients, each holding one connection, for a set of
+// servers. Unlike Client, it's safe for concurrent use; a checked out
+// Client belongs to one goroutine until it's returned.
+type Pool struct {
+	opts      PoolOptions
+	sel       ServerSelector
+	newClient func(host string) *Client
+
+	mu      sync.Mutex
+	servers map[string]*serverPool
+	inUse   map[*Client]*poolEntry
+	stats   PoolStats
+	closed  bool
+}
+
+// NewPool makes a pool for the servers in sel, building Clients with
+// newClient as for NewMultiClient.
+func NewPool(sel ServerSelector, newClient func(host string) *Client, opts PoolOptions) *Pool {
+	p := &Pool{
+		opts:      opts,
+		sel:       sel,
+		newClient: newClient,
+		servers:   make(map[string]*serverPool),
+		inUse:     make(map[*Client]*poolEntry),
+	}
+	if p.opts.HealthCheck == nil {
+		p.opts.HealthCheck = func(c *Client) error {
+			_, err := c.Version()
+			return err
+		}
+	}
+	for _, host := range sel.Servers() {
+		p.servers[host] = &serverPool{}
+	}
+	return p
+}
+
+// CheckoutKey checks out a Client for the server owning key.
+func (p *Pool) CheckoutKey(key string) (*Client, error) {
+	return p.Checkout(p.sel.Servers()[p.sel.Pick(key)])
+}
+
+// Checkout hands out an idle Client for host, or a new one if there are
+// none and the server is under Size. The Client must be given back with
+// Return.
+func (p *Pool) Checkout(host string) (*Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	sp, ok := p.servers[host]
+	if !ok {
+		p.mu.Unlock()
+		return nil, ErrNoServers
+	}
+	for len(sp.idle) > 0 {
+		e := sp.idle[len(sp.idle)-1]
+		sp.idle = sp.idle[:len(sp.idle)-1]
+		if p.expired(e) {
+			p.discard(e)
+			continue
+		}
+		if p.opts.HealthCheckIdle != 0 && time.Since(e.lastUsed) > p.opts.HealthCheckIdle {
+			// Don't hold the lock over a round trip.
+			p.mu.Unlock()
+			err := p.opts.HealthCheck(e.c)
+			p.mu.Lock()
+			if err != nil {
+				p.stats.HealthFailures++
+				p.discard(e)
+				continue
+			}
+		}
+		p.inUse[e.c] = e
+		p.mu.Unlock()
+		return e.c, nil
+	}
+
+	// Nothing idle; open another if under Size, else queue up for one to
+	// be returned. Queueing under the same lock as the idle check means a
+	// Return can't slip in between and go unnoticed.
+	if p.opts.Size == 0 || sp.open < p.opts.Size {
+		sp.open++
+		p.mu.Unlock()
+	} else {
+		w := make(chan *poolEntry, 1)
+		sp.waiters = append(sp.waiters, w)
+		p.mu.Unlock()
+		e, err := p.wait(sp, w)
+		if err != nil || e != nil {
+			return e.client(), err
+		}
+	}
+	now := time.Now()
+	e := &poolEntry{c: p.newClient(host), sp: sp, created: now, lastUsed: now}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.release(sp)
+		return nil, ErrPoolClosed
+	}
+	p.stats.Opened++
+	p.inUse[e.c] = e
+	return e.c, nil
+}
+
+// wait blocks a queued Checkout until it's sent a connection, or nil for
+// room to open one.
+func (p *Pool) wait(sp *serverPool, w chan *poolEntry) (*poolEntry, error) {
+	var timeout <-chan time.Time
+	if p.opts.WaitTimeout != 0 {
+		t := time.NewTimer(p.opts.WaitTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case e, ok := <-w:
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+		return e, nil
+	case <-timeout:
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, qw := range sp.waiters {
+		if qw == w {
+			sp.waiters = append(sp.waiters[:i], sp.waiters[i+1:]...)
+			p.stats.WaitTimeouts++
+			return nil, ErrPoolTimeout
+		}
+	}
+	// Already dequeued, so something was sent as the timer fired.
+	e, ok := <-w
+	if !ok {
+		return nil, ErrPoolClosed
+	}
+	return e, nil
+}
+
+// nextWaiter dequeues the oldest waiting Checkout. Called with mu held.
+func (sp *serverPool) nextWaiter() chan *poolEntry {
+	if len(sp.waiters) == 0 {
+		return nil
+	}
+	w := sp.waiters[0]
+	sp.waiters[0] = nil
+	sp.waiters = sp.waiters[1:]
+	return w
+}
+
+func (e *poolEntry) client() *Client {
+	if e == nil {
+		return nil
+	}
+	return e.c
+}
+
+// Return gives a checked out Client back. Clients that lost their
+// connection, have requests in flight, or are past MaxLifetime or MaxIdle
+// are closed instead of kept.
+func (p *Pool) Return(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.inUse[c]
+	if !ok {
+		return
+	}
+	delete(p.inUse, c)
+	sp := e.sp
+	e.lastUsed = time.Now()
+	dirty := c.dropped || c.MetaInflight() != 0 ||
+		(c.cn != nil && c.cn.b.Writer.Buffered() != 0)
+	if p.closed || dirty || p.expired(e) {
+		p.discard(e)
+		return
+	}
+	if w := sp.nextWaiter(); w != nil {
+		p.inUse[c] = e
+		w <- e
+		return
+	}
+	if p.opts.MaxIdle != 0 && len(sp.idle) >= p.opts.MaxIdle {
+		p.discard(e)
+		return
+	}
+	sp.idle = append(sp.idle, e)
+}
+
+func (p *Pool) expired(e *poolEntry) bool {
+	return p.opts.MaxLifetime != 0 && time.Since(e.created) > p.opts.MaxLifetime
+}
+
+// discard closes a connection and frees its slot. Called with mu held.
+func (p *Pool) discard(e *poolEntry) {
+	e.c.Close()
+	p.stats.Closed++
+	p.release(e.sp)
+}
+
+// release gives up a connection's place under Size, to the oldest waiter
+// if there is one. Called with mu held.
+func (p *Pool) release(sp *serverPool) {
+	if w := sp.nextWaiter(); w != nil {
+		w <- nil
+		return
+	}
+	sp.open--
+}
+
+// Stats returns the pool counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	for _, sp := range p.servers {
+		s.Idle += len(sp.idle)
+	}
+	s.InUse = len(p.inUse)
+	return s
+}
+
+// Close closes idle connections, wakes waiting Checkouts with
+// ErrPoolClosed and stops handing out new ones. Clients still checked out
+// are closed when returned.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, sp := range p.servers {
+		for _, w := range sp.waiters {
+			close(w)
+		}
+		sp.waiters = nil
+		for _, e := range sp.idle {
+			p.discard(e)
+		}
+		sp.idle = nil
+	}
+}
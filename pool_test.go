@@ -0,0 +1,220 @@
+package mctester
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// versionServer answers every line with a version.
+func versionServer(t *testing.T) string {
+	return fakeServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			if _, err := io.WriteString(conn, "VERSION 1.6.21\r\n"); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func newTestPool(t *testing.T, opts PoolOptions) *Pool {
+	sel, err := NewModuloSelector([]string{versionServer(t)}, nil, HashXX)
+	if err != nil {
+		t.Fatalf("selector error: %v", err)
+	}
+	p := NewPool(sel, newcliHost, opts)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := newTestPool(t, PoolOptions{MaxIdle: 1})
+	a, err := p.CheckoutKey("foo")
+	if err != nil {
+		t.Fatalf("checkout error: %v", err)
+	}
+	b, _ := p.CheckoutKey("foo")
+	if a == b {
+		t.Fatalf("same client checked out twice")
+	}
+	p.Return(a)
+	p.Return(b)
+	if s := p.Stats(); s.Opened != 2 || s.Closed != 1 || s.Idle != 1 || s.InUse != 0 {
+		t.Fatalf("bad stats after return past max idle: %+v", s)
+	}
+	if c, _ := p.CheckoutKey("foo"); c != a {
+		t.Fatalf("expected idle client to be reused")
+	}
+
+	// a client that lost its connection isn't kept.
+	a.dropped = true
+	p.Return(a)
+	if s := p.Stats(); s.Idle != 0 || s.Closed != 2 {
+		t.Fatalf("dropped client was kept: %+v", s)
+	}
+
+	p.Close()
+	if _, err := p.CheckoutKey("foo"); err != ErrPoolClosed {
+		t.Fatalf("expected closed pool error, got: %v", err)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	p := newTestPool(t, PoolOptions{Size: 1, WaitTimeout: 20 * time.Millisecond})
+	a, _ := p.CheckoutKey("foo")
+	if _, err := p.CheckoutKey("foo"); err != ErrPoolTimeout {
+		t.Fatalf("expected pool timeout, got: %v", err)
+	}
+
+	got := make(chan *Client)
+	go func() {
+		c, _ := p.CheckoutKey("foo")
+		got <- c
+	}()
+	time.Sleep(5 * time.Millisecond)
+	p.Return(a)
+	if c := <-got; c != a {
+		t.Fatalf("expected returned client handed to waiter")
+	}
+	if s := p.Stats(); s.Opened != 1 || s.InUse != 1 || s.WaitTimeouts != 1 {
+		t.Fatalf("bad stats: %+v", s)
+	}
+}
+
+// waitQueued blocks until n Checkouts are queued for the pool's server.
+func waitQueued(p *Pool, n int) {
+	for {
+		p.mu.Lock()
+		queued := 0
+		for _, sp := range p.servers {
+			queued += len(sp.waiters)
+		}
+		p.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolWaiters(t *testing.T) {
+	p := newTestPool(t, PoolOptions{Size: 1})
+	checkout := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			c, err := p.CheckoutKey("foo")
+			if err == nil {
+				p.Return(c)
+			}
+			done <- err
+		}()
+		return done
+	}
+
+	// Return while a Checkout is waiting hands the client over.
+	a, _ := p.CheckoutKey("foo")
+	done := checkout()
+	waitQueued(p, 1)
+	p.Return(a)
+	if err := <-done; err != nil {
+		t.Fatalf("waiter failed after return: %v", err)
+	}
+	if s := p.Stats(); s.Opened != 1 || s.Idle != 1 || s.InUse != 0 {
+		t.Fatalf("bad stats after handoff: %+v", s)
+	}
+
+	// A discarded client makes room for the waiter to open another.
+	a, _ = p.CheckoutKey("foo")
+	done = checkout()
+	waitQueued(p, 1)
+	a.dropped = true
+	p.Return(a)
+	if err := <-done; err != nil {
+		t.Fatalf("waiter failed after discard: %v", err)
+	}
+	if s := p.Stats(); s.Opened != 2 || s.Closed != 1 {
+		t.Fatalf("bad stats after discard: %+v", s)
+	}
+
+	// Close wakes waiters.
+	a, _ = p.CheckoutKey("foo")
+	done = checkout()
+	waitQueued(p, 1)
+	p.Close()
+	if err := <-done; err != ErrPoolClosed {
+		t.Fatalf("expected closed pool error, got: %v", err)
+	}
+	p.Return(a)
+}
+
+func TestPoolLifetimeAndHealth(t *testing.T) {
+	p := newTestPool(t, PoolOptions{MaxLifetime: time.Millisecond})
+	a, _ := p.CheckoutKey("foo")
+	p.Return(a)
+	time.Sleep(5 * time.Millisecond)
+	if b, _ := p.CheckoutKey("foo"); b == a {
+		t.Fatalf("expected expired client to be replaced")
+	}
+
+	fail := true
+	p = newTestPool(t, PoolOptions{
+		HealthCheckIdle: time.Nanosecond,
+		HealthCheck: func(c *Client) error {
+			if fail {
+				fail = false
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	})
+	a, _ = p.CheckoutKey("foo")
+	p.Return(a)
+	time.Sleep(time.Millisecond)
+	if b, _ := p.CheckoutKey("foo"); b == a {
+		t.Fatalf("expected unhealthy client to be replaced")
+	}
+	if s := p.Stats(); s.HealthFailures != 1 || s.Closed != 1 {
+		t.Fatalf("bad stats after health failure: %+v", s)
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	p := newTestPool(t, PoolOptions{Size: 3, HealthCheckIdle: time.Millisecond})
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				c, err := p.CheckoutKey("foo")
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = c.Version()
+				p.Return(c)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("worker error: %v", err)
+	}
+	if s := p.Stats(); s.Opened > 3 || s.InUse != 0 {
+		t.Fatalf("pool went over size: %+v", s)
+	}
+}
@@ -1,16 +1,12 @@
 // Request and response parsing.
-// use xxhash for server list hash.
-// https://github.com/cespare/xxhash
-// + optional crc32?
-// consistent hashing?
-// https://github.com/stathat/consistent MIT licensed.
-// maybe just an example that uses it separately?
+// Server selection lives in selector.go.
 
 package mctester
 
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -29,6 +25,12 @@ var (
 	ErrKeyDoesNotMatch    = errors.New("response key does not match request key")
 	ErrUnexpectedResponse = errors.New("unexpected response from server")
 	ErrServerError        = errors.New("SERVER_ERROR received")
+	ErrClientError        = errors.New("CLIENT_ERROR received")
+	ErrUnknownCommand     = errors.New("ERROR received, command unknown to server")
+	ErrCorruptFlags       = errors.New("corrupt return flags in response")
+	ErrTimeout            = errors.New("network timeout")
+	ErrNotConnected       = errors.New("not connected")
+	ErrDisconnected       = errors.New("connection lost and reconnect disabled")
 )
 
 type mcConn struct {
@@ -47,27 +49,209 @@ func (c *Client) connectToMc() (*mcConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.TLSConfig != nil {
+		tc, err := c.tlsHandshake(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
 	cn := mcConn{conn: conn}
 	cn.b = bufio.NewReadWriter(bufio.NewReaderSize(conn, c.RBufSize), bufio.NewWriterSize(conn, c.WBufSize))
+	if c.SASL != nil {
+		err = c.saslAuth(&cn)
+	} else if c.AuthUsername != "" {
+		err = c.textAuth(&cn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	return &cn, err
 }
 
+// ConnStats counts connection events over the life of a Client.
+type ConnStats struct {
+	Connects        uint64 // successful connects, including reconnects
+	Reconnects      uint64 // successful connects after a dropped connection
+	ConnectFailures uint64 // failed dial attempts
+	Failures        uint64 // connections dropped due to an error
+	TLSResumed      uint64 // connects that resumed a TLS session
+}
+
+// connect dials the server if there's no connection, and refreshes the
+// deadline for the operation about to run. After failures it waits out the
+// reconnect backoff first.
+func (c *Client) connect() error {
+	if c.cn == nil {
+		if c.dropped && c.DisableReconnect {
+			return ErrDisconnected
+		}
+		c.backoff()
+		cn, err := c.connectToMc()
+		if err != nil {
+			fmt.Println("FAILED TO CONNECT")
+			c.stats.ConnectFailures++
+			c.failStreak++
+			return err
+		}
+		c.cn = cn
+		c.stats.Connects++
+		if tc, ok := cn.conn.(*tls.Conn); ok && tc.ConnectionState().DidResume {
+			c.stats.TLSResumed++
+		}
+		if c.dropped {
+			c.stats.Reconnects++
+			c.dropped = false
+		}
+	}
+	return c.refreshDeadline()
+}
+
+// backoff sleeps ReconnectBackoff, doubled for each failure in a row up to
+// ReconnectMaxBackoff.
+func (c *Client) backoff() {
+	if c.ReconnectBackoff == 0 || c.failStreak == 0 {
+		return
+	}
+	wait := c.ReconnectBackoff
+	for i := 1; i < c.failStreak; i++ {
+		wait *= 2
+		if c.ReconnectMaxBackoff != 0 && wait >= c.ReconnectMaxBackoff {
+			wait = c.ReconnectMaxBackoff
+			break
+		}
+	}
+	time.Sleep(wait)
+}
+
+// refreshDeadline gives the next read or write NetTimeout to complete.
+func (c *Client) refreshDeadline() error {
+	if c.NetTimeout == 0 {
+		return nil
+	}
+	return c.cn.conn.SetDeadline(time.Now().Add(c.NetTimeout))
+}
+
+// isConnErr is true for errors that leave the connection unusable: I/O
+// failures, or responses we couldn't parse, after which there's no telling
+// where the next response starts.
+func isConnErr(err error) bool {
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, ErrUnexpectedResponse),
+		errors.Is(err, ErrCorruptValue),
+		errors.Is(err, ErrCorruptFlags),
+		errors.Is(err, ErrUnknownStatus):
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// connErr drops the connection after any error that leaves it unusable.
+// The next command reconnects unless DisableReconnect is set.
+// Timeouts are returned wrapped in ErrTimeout.
+func (c *Client) connErr(err error) error {
+	if err == nil {
+		c.failStreak = 0
+		return nil
+	}
+	if !isConnErr(err) {
+		return err
+	}
+	c.dropConn()
+	c.stats.Failures++
+	c.failStreak++
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+// dropConn closes and forgets the connection along with anything in flight.
+func (c *Client) dropConn() {
+	if c.cn != nil {
+		c.cn.conn.Close()
+		c.cn = nil
+		c.dropped = true
+	}
+	c.resetInflight()
+}
+
+// ConnStats returns connection counters for this client.
+func (c *Client) ConnStats() ConnStats {
+	return c.stats
+}
+
+// Connected is true if the client holds a connection. Connections are
+// made lazily, and dropped on errors.
+func (c *Client) Connected() bool {
+	return c.cn != nil
+}
+
+// Close closes the connection, forgetting anything in flight. The client
+// stays usable; the next command connects again.
+func (c *Client) Close() error {
+	c.resetInflight()
+	if c.cn == nil {
+		return nil
+	}
+	err := c.cn.conn.Close()
+	c.cn = nil
+	return err
+}
+
 type Client struct {
 	ConnectTimeout time.Duration
 	// read or write timeout
 	NetTimeout time.Duration
-	Host       string
-	socket     string
-	cn         *mcConn
-	WBufSize   int
-	RBufSize   int
+	// AutoOpaque tags each meta request with an O opaque and tracks it
+	// until its response is received. Don't pass O in flags with this on.
+	AutoOpaque bool
+	// Wait before reconnecting after a dropped connection. Doubles for each
+	// failure in a row, up to ReconnectMaxBackoff if set.
+	ReconnectBackoff    time.Duration
+	ReconnectMaxBackoff time.Duration
+	// DisableReconnect makes commands return ErrDisconnected after the
+	// connection is dropped, instead of reconnecting.
+	DisableReconnect bool
+	// NoReply sends text storage commands with noreply. The server may
+	// still send errors, which will desync the next command.
+	NoReply bool
+	// SASL authenticates each new connection over the binary protocol. A
+	// failure fails the connect.
+	SASL SASLMechanism
+	// AuthUsername and AuthPassword log in over the text protocol on each
+	// new connection, for servers using an auth file. Ignored if SASL is set.
+	AuthUsername string
+	AuthPassword string
+	// TLSConfig wraps each new connection in TLS; see NewTLSConfig.
+	TLSConfig *tls.Config
+	Host      string
+	socket    string
+	cn        *mcConn
+	WBufSize  int
+	RBufSize  int
 	// any necessary locks? channels?
 	// binprot structure cache.
-	binpkt         *packet
-	opaque         uint32 // just for binprot?
-	pipelines      int
-	keyPrefix      string
-	stripKeyPrefix bool
+	binpkt       *packet
+	opaque       uint32 // binprot and AutoOpaque meta requests
+	inflight     []MetaRequest
+	inflightHead int
+	// quiet requests skipped over while matching, for MetaQuietBatch.
+	suppressed        []MetaRequest
+	collectSuppressed bool
+	pipelines         int
+	keyPrefix         string
+	stripKeyPrefix    bool
+	stats             ConnStats
+	dropped           bool   // connection was lost; the next connect is a reconnect
+	failStreak        int    // failures since the last success, for backoff
+	rline             []byte // reused for text response lines
 }
 
 func NewClient(host string, socket string, pipelines uint, keyPrefix string, stripKeyPrefix bool) (client *Client) {
@@ -127,87 +311,244 @@ const (
 	McDELETED
 	McNOT_FOUND
 	McERROR
+	McHD
+	McEXISTS
+	McTOUCHED
 )
 
 // TODO: reverse lookup status codes?
 
+// MetaResponse is a parsed meta protocol response. Return flags are decoded
+// into the matching fields; anything not asked for is left at zero.
+// Flags holds the raw return flags for anything not decoded here.
+// Key, Opaque and Flags slice into the response line.
+type MetaResponse struct {
+	Code        McCode
+	Value       []byte
+	Flags       []byte
+	CAS         uint64 // c
+	TTL         int64  // t: -1 for no expiration
+	Size        uint64 // s
+	ClientFlags uint64 // f
+	Key         []byte // k
+	Opaque      []byte // O
+	LastAccess  uint64 // l: seconds since last access
+	Fetched     bool   // h: item has been fetched before
+	Won         bool   // W: client has won the recache flag
+	Stale       bool   // X: item is stale
+	AlreadyWon  bool   // Z: a win token was already handed out
+	// Message is the text following SERVER_ERROR, CLIENT_ERROR or ERROR.
+	Message []byte
+	// Request is the originating request, if tracked with AutoOpaque.
+	Request MetaRequest
+	// copy of the response line, which Flags, Key, Opaque and Message
+	// point into.
+	line []byte
+}
+
+// Reset clears the response while keeping the value and line buffers for
+// reuse.
+func (r *MetaResponse) Reset() {
+	value, line := r.Value[:0], r.line[:0]
+	*r = MetaResponse{}
+	r.Value, r.line = value, line
+}
+
+// Number decodes the value as an unsigned integer, as returned by ma.
+func (r *MetaResponse) Number() (uint64, error) {
+	n, err := parseMetaUint(r.Value)
+	if err != nil {
+		return 0, ErrCorruptValue
+	}
+	return n, nil
+}
+
+// parseMetaUint parses a numeric flag token. Unlike ParseUint it fails
+// on empty or partially numeric input.
+func parseMetaUint(arg []byte) (uint64, error) {
+	if len(arg) == 0 {
+		return 0, ErrCorruptFlags
+	}
+	n, offset := ParseUint(arg)
+	if offset != 0 || arg[0] < '0' || arg[0] > '9' {
+		return 0, ErrCorruptFlags
+	}
+	return n, nil
+}
+
+// parseFlags walks the space separated return flags and fills in the
+// matching fields.
+func (r *MetaResponse) parseFlags(rflags []byte) (err error) {
+	r.Flags = rflags
+	for len(rflags) != 0 {
+		tok := rflags
+		if end := bytes.IndexByte(rflags, ' '); end != -1 {
+			tok = rflags[:end]
+			rflags = rflags[end+1:]
+		} else {
+			rflags = nil
+		}
+		if len(tok) == 0 {
+			continue
+		}
+
+		arg := tok[1:]
+		switch tok[0] {
+		case 'c':
+			r.CAS, err = parseMetaUint(arg)
+		case 't':
+			if len(arg) == 2 && arg[0] == '-' && arg[1] == '1' {
+				r.TTL = -1
+			} else {
+				var ttl uint64
+				ttl, err = parseMetaUint(arg)
+				r.TTL = int64(ttl)
+			}
+		case 's':
+			r.Size, err = parseMetaUint(arg)
+		case 'f':
+			r.ClientFlags, err = parseMetaUint(arg)
+		case 'k':
+			r.Key = arg
+		case 'O':
+			r.Opaque = arg
+		case 'l':
+			r.LastAccess, err = parseMetaUint(arg)
+		case 'h':
+			var h uint64
+			h, err = parseMetaUint(arg)
+			r.Fetched = h != 0
+		case 'W':
+			r.Won = true
+		case 'X':
+			r.Stale = true
+		case 'Z':
+			r.AlreadyWon = true
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseMetaResponse reads one meta response, returning the raw return flags.
+// See ParseMetaResponseInto for a version that decodes the flags.
 func (c *Client) ParseMetaResponse() (rflags []byte, value []byte, code McCode, err error) {
+	r := MetaResponse{}
+	if err := c.ParseMetaResponseInto(&r); err != nil {
+		return nil, nil, 0, err
+	}
+	return r.Flags, r.Value, r.Code, nil
+}
+
+// ParseMetaResponseInto reads one meta response into r. r is reset first
+// and its buffers are reused if large enough, so a single MetaResponse can
+// be used for a whole run without allocating per response. Value, Flags,
+// Key, Opaque and Message are only good until r is reused.
+func (c *Client) ParseMetaResponseInto(r *MetaResponse) (err error) {
+	r.Reset()
 	// look for response
-	line, err := c.cn.b.ReadBytes('\n')
+	r.line, err = readLine(c.cn.b.Reader, r.line)
 	if err != nil {
-		return nil, nil, 0, err
+		return err
+	}
+	line := r.line
+	if len(line) < 4 || line[len(line)-2] != '\r' {
+		return ErrUnexpectedResponse
+	}
+	// Strip the \r\n, then split the status token from the rest.
+	line = line[:len(line)-2]
+	status := line
+	var rest []byte
+	if i := bytes.IndexByte(line, ' '); i != -1 {
+		status = line[:i]
+		rest = line[i+1:]
 	}
 
 	// VA flags token token token
-	// TODO: There _must_ be some way to switch the bytes directly?
-	// TODO: Can avoid splitting the response flags here.
-	// bytes.IndexByte() to find and parse the thinger.
-	// could also just roll through it with range and roll up the parseUint(),
-	// having it stop at a space or newline.
-	switch string(line[0:2]) {
+	switch string(status) {
 	case "VA":
 		// VA [size] [flags]
-		//parts := bytes.Split(line[:len(line)-2], []byte(" "))
-		size, offset := ParseUint(line[3:])
-		// FIXME: if offset is 0, we failed?
-		rflags = line[4+offset : len(line)-2]
+		size, offset := ParseUint(rest)
+		if len(rest) == 0 || rest[0] < '0' || rest[0] > '9' {
+			return ErrUnexpectedResponse
+		}
+		if offset != 0 {
+			if rest[offset] != ' ' {
+				return ErrUnexpectedResponse
+			}
+			if err := r.parseFlags(rest[offset+1:]); err != nil {
+				return err
+			}
+		}
 		// Have some value data to read. + 2 bytes for \r\n
-		value = make([]byte, size+2)
-		read, err := io.ReadFull(c.cn.b, value)
+		if uint64(cap(r.Value)) < size+2 {
+			r.Value = make([]byte, size+2)
+		} else {
+			r.Value = r.Value[:size+2]
+		}
+		value := r.Value
+		_, err := io.ReadFull(c.cn.b, value)
 		if err != nil {
-			return nil, nil, 0, err
+			return err
 		}
-		fmt.Printf("res size: %d read: %d\n", size, read)
 		// check for \r\n, cut extra bytes off.
 		if !bytes.Equal(value[len(value)-2:], []byte("\r\n")) {
-			return nil, nil, 0, ErrCorruptValue
+			return ErrCorruptValue
 		}
-		value = value[:size]
-		code = McVA
+		r.Value = value[:size]
+		r.Code = McVA
+		return nil
+	case "HD":
+		// Success with no value: set, delete, get without v.
+		r.Code = McHD
 	case "OK":
-		//parts := bytes.Split(line[:len(line)-2], []byte(" "))
-		// Chop "HD " and rest are flags.
-		rflags = line[3 : len(line)-2]
-		// No value to read, so we're done parsing the response.
-		code = McOK
+		// Older servers used OK in place of HD.
+		r.Code = McOK
 	case "EN":
 		// MetaGet miss
-		code = McEN
+		r.Code = McEN
 	case "ME":
-		// Meta Debug command
-		value = line[3 : len(line)-2]
-		code = McME
+		// Meta Debug command. Copied out, as rest lives in the line buffer
+		// and Reset keeps Value around as the value buffer.
+		r.Value = append(r.Value, rest...)
+		r.Code = McME
+		return nil
 	case "NS":
 		// Meta NOT_STORED
-		rflags = line[3 : len(line)-2]
-		code = McNS
+		r.Code = McNS
 	case "EX":
 		// Meta EXISTS (set or delete)
-		rflags = line[3 : len(line)-2]
-		code = McEX
+		r.Code = McEX
 	case "NF":
 		// Meta NOT_FOUND (set or delete)
-		rflags = line[3 : len(line)-2]
-		code = McNF
+		r.Code = McNF
 	case "MN":
 		// Meta NOP (response flush marker)
-		code = McMN
-	case "SE":
-		// Probably SERVER_ERRROR
-		code = McSE
-	case "ER":
-		// Probably ERROR (client side)
-		code = McER
-	case "CL":
-		// Probably CLIENT_ERROR (client side)
-		code = McCL
+		r.Code = McMN
+		return nil
+	case "SERVER_ERROR":
+		r.Message = rest
+		r.Code = McSE
+		return nil
+	case "CLIENT_ERROR":
+		r.Message = rest
+		r.Code = McCL
+		return nil
+	case "ERROR":
+		// Unknown command. Some builds add a reason after ERROR.
+		r.Message = rest
+		r.Code = McER
+		return nil
 	default:
-		fmt.Printf("Unknown: %s\n", string(line[0:2]))
+		fmt.Printf("Unknown: %s\n", string(status))
 		// TODO: Try error wrapping?
-		return nil, nil, 0, ErrUnknownStatus
+		return ErrUnknownStatus
 	}
 
-	return
+	// No value to read, so we're done parsing the response.
+	return r.parseFlags(rest)
 }
 
 // Closures are the main Go pattern due to lack of macros?
@@ -219,14 +560,10 @@ func (c *Client) runNow(key string, avail int, fn func() error) (err error) {
 		return ErrKeyTooLong
 	}
 
-	if c.cn == nil {
-		cn, err := c.connectToMc()
-		if err != nil {
-			fmt.Println("FAILED TO CONNECT")
-			return err
-		}
-		c.cn = cn
+	if err := c.connect(); err != nil {
+		return err
 	}
+	defer func() { err = c.connErr(err) }()
 
 	b := c.cn.b
 	// To avoid checking errors a bunch of times, ensure there's enough space
@@ -242,12 +579,13 @@ func (c *Client) runNow(key string, avail int, fn func() error) (err error) {
 }
 
 func (c *Client) MetaGet(key string, flags string) (err error) {
-	err = c.runNow(key, len(key)+len(flags)+6, func() error {
+	err = c.runNow(key, len(key)+len(flags)+18, func() error {
 		b := c.cn.b
 		b.WriteString("mg ")
 		b.WriteString(key)
 		b.WriteString(" ")
 		b.WriteString(flags)
+		c.trackMeta("mg", key, hasQuietFlag(flags))
 		b.WriteString("\r\n")
 		return nil
 	})
@@ -256,12 +594,13 @@ func (c *Client) MetaGet(key string, flags string) (err error) {
 }
 
 func (c *Client) MetaSet(key string, flags string, value []byte) (err error) {
-	err = c.runNow(key, len(key)+len(flags)+6, func() error {
+	err = c.runNow(key, len(key)+len(flags)+18, func() error {
 		b := c.cn.b
 		b.WriteString("ms ")
 		b.WriteString(key)
 		b.WriteString(" ")
 		b.WriteString(flags)
+		c.trackMeta("ms", key, hasQuietFlag(flags))
 		b.WriteString("\r\n")
 		// For large sets this ends up flushing twice.
 		// Change the interface to require \r\n or append or what?
@@ -272,24 +611,168 @@ func (c *Client) MetaSet(key string, flags string, value []byte) (err error) {
 	return
 }
 
+// MetaGetFlags is MetaGet with typed flags, which are checked before
+// anything is queued.
+func (c *Client) MetaGetFlags(key string, f MetaFlags) (err error) {
+	f, err = c.metaFlags(f, metaCmdGet)
+	if err != nil {
+		return err
+	}
+	err = c.runNow(key, len(key)+metaFlagsMaxLen+5, func() error {
+		b := c.cn.b
+		b.WriteString("mg ")
+		b.WriteString(key)
+		f.write(b.Writer)
+		c.trackMeta("mg", key, f.has(mfQuiet))
+		b.WriteString("\r\n")
+		return nil
+	})
+	return
+}
+
+// MetaSetFlags queues an ms with typed flags. Unlike MetaSet the value
+// length is written out for you.
+func (c *Client) MetaSetFlags(key string, f MetaFlags, value []byte) (err error) {
+	f, err = c.metaFlags(f, metaCmdSet)
+	if err != nil {
+		return err
+	}
+	err = c.runNow(key, len(key)+metaFlagsMaxLen+27, func() error {
+		b := c.cn.b
+		b.WriteString("ms ")
+		b.WriteString(key)
+		b.WriteByte(' ')
+		writeUint(b.Writer, uint64(len(value)))
+		f.write(b.Writer)
+		c.trackMeta("ms", key, f.has(mfQuiet))
+		b.WriteString("\r\n")
+		b.Write(value)
+		b.WriteString("\r\n")
+		return nil
+	})
+	return
+}
+
+// MetaDeleteFlags is MetaDelete with typed flags.
+func (c *Client) MetaDeleteFlags(key string, f MetaFlags) (err error) {
+	f, err = c.metaFlags(f, metaCmdDelete)
+	if err != nil {
+		return err
+	}
+	err = c.runNow(key, len(key)+metaFlagsMaxLen+5, func() error {
+		b := c.cn.b
+		b.WriteString("md ")
+		b.WriteString(key)
+		f.write(b.Writer)
+		c.trackMeta("md", key, f.has(mfQuiet))
+		b.WriteString("\r\n")
+		return nil
+	})
+	return
+}
+
 func (c *Client) MetaDelete(key string, flags string) (err error) {
-	err = c.runNow(key, len(key)+len(flags)+6, func() error {
+	err = c.runNow(key, len(key)+len(flags)+18, func() error {
 		b := c.cn.b
 		b.WriteString("md ")
 		b.WriteString(key)
 		b.WriteString(" ")
 		b.WriteString(flags)
+		c.trackMeta("md", key, hasQuietFlag(flags))
 		b.WriteString("\r\n")
 		return nil
 	})
 	return
 }
 
+// MetaArithMode selects increment or decrement for MetaArithmetic.
+type MetaArithMode int
+
+const (
+	MetaArithIncr MetaArithMode = iota
+	MetaArithDecr
+)
+
+// MetaArith describes an ma request. The zero value increments by 0 without
+// autovivifying, so at least set Delta.
+type MetaArith struct {
+	Mode  MetaArithMode
+	Delta uint64 // D
+	// Vivify creates missing items with value Initial and TTL VivifyTTL.
+	Vivify    bool
+	Initial   uint64 // J
+	VivifyTTL uint32 // N
+	// CAS, if non-zero, only applies the change if the item CAS matches.
+	CAS uint64 // C
+}
+
+// MetaArithmetic queues an ma request. flags are any extra flags to send,
+// ie; "v" to return the new value, "c" for the CAS, "q" for quiet mode.
+// Read the result back with MetaReceive; MetaResponse.Number() decodes the
+// value.
+func (c *Client) MetaArithmetic(key string, arith *MetaArith, flags string) (err error) {
+	// ma + key + mode + four numeric flags of up to 22 bytes each.
+	err = c.runNow(key, len(key)+len(flags)+112, func() error {
+		b := c.cn.b
+		b.WriteString("ma ")
+		b.WriteString(key)
+		writeMetaArith(b.Writer, arith)
+		if flags != "" {
+			b.WriteString(" ")
+			b.WriteString(flags)
+		}
+		c.trackMeta("ma", key, hasQuietFlag(flags))
+		b.WriteString("\r\n")
+		return nil
+	})
+	return
+}
+
+// MetaArithmeticFlags is MetaArithmetic with typed flags.
+func (c *Client) MetaArithmeticFlags(key string, arith *MetaArith, f MetaFlags) (err error) {
+	f, err = c.metaFlags(f, metaCmdArith)
+	if err != nil {
+		return err
+	}
+	err = c.runNow(key, len(key)+metaFlagsMaxLen+100, func() error {
+		b := c.cn.b
+		b.WriteString("ma ")
+		b.WriteString(key)
+		writeMetaArith(b.Writer, arith)
+		f.write(b.Writer)
+		c.trackMeta("ma", key, f.has(mfQuiet))
+		b.WriteString("\r\n")
+		return nil
+	})
+	return
+}
+
+func writeMetaArith(b *bufio.Writer, arith *MetaArith) {
+	if arith.Mode == MetaArithDecr {
+		b.WriteString(" MD")
+	} else {
+		b.WriteString(" MI")
+	}
+	b.WriteString(" D")
+	writeUint(b, arith.Delta)
+	if arith.Vivify {
+		b.WriteString(" N")
+		writeUint(b, uint64(arith.VivifyTTL))
+		b.WriteString(" J")
+		writeUint(b, arith.Initial)
+	}
+	if arith.CAS != 0 {
+		b.WriteString(" C")
+		writeUint(b, arith.CAS)
+	}
+}
+
 // TODO: MetaDebug can't pipe? doesn't take/return flags.
 
 func (c *Client) MetaNoop() (err error) {
 	err = c.runNow("", 4, func() error {
 		b := c.cn.b
+		c.trackMeta("mn", "", false)
 		b.WriteString("mn\r\n")
 		return nil
 	})
@@ -297,23 +780,92 @@ func (c *Client) MetaNoop() (err error) {
 }
 
 func (c *Client) MetaFlush() (err error) {
+	if c.cn == nil {
+		return ErrNotConnected
+	}
+	if err := c.refreshDeadline(); err != nil {
+		return err
+	}
 	b := c.cn.b
 	err = b.Flush()
-	return err
+	return c.connErr(err)
 }
 
 // Note: User should stop pulling when they know no more responses will
 // happen, else this will wait forever.
 func (c *Client) MetaReceive() (rflags []byte, value []byte, code McCode, err error) {
+	r := MetaResponse{}
+	if err := c.MetaReceiveInto(&r); err != nil {
+		return nil, nil, 0, err
+	}
+	return r.Flags, r.Value, r.Code, nil
+}
+
+// MetaReceiveInto is MetaReceive with return flags parsed into r.
+// r may be reused between calls. With AutoOpaque set r.Request holds the
+// request the response belongs to.
+func (c *Client) MetaReceiveInto(r *MetaResponse) (err error) {
+	if c.cn == nil {
+		return ErrNotConnected
+	}
+	if err := c.refreshDeadline(); err != nil {
+		return err
+	}
+	defer func() { err = c.connErr(err) }()
 	b := c.cn.b
 	// Auto flush if there's something buffered.
 	if b.Writer.Buffered() != 0 {
 		if err := b.Flush(); err != nil {
-			return nil, nil, 0, err
+			return err
 		}
 	}
-	rflags, value, code, err = c.ParseMetaResponse()
-	return
+	if err := c.ParseMetaResponseInto(r); err != nil {
+		return err
+	}
+	if c.AutoOpaque {
+		return c.matchInflight(r)
+	}
+	return nil
+}
+
+// MetaReceiveResponse returns a freshly allocated MetaResponse.
+func (c *Client) MetaReceiveResponse() (r *MetaResponse, err error) {
+	r = &MetaResponse{}
+	if err = c.MetaReceiveInto(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// MetaGat is the meta equivalent of Gats: an mg which returns the value,
+// flags and CAS while updating the TTL. Unlike the other meta commands it
+// waits for the response, so nothing else may be in flight.
+func (c *Client) MetaGat(key string, ttl uint32) (flags uint64, value []byte, cas uint64, code McCode, err error) {
+	r := MetaResponse{}
+	if err = c.metaSync(key, MetaFlags{}.WithValue().WithClientFlags().WithCAS().WithTTL(ttl), &r); err != nil {
+		return 0, nil, 0, 0, err
+	}
+	return r.ClientFlags, r.Value, r.CAS, r.Code, nil
+}
+
+// MetaTouch updates the TTL of an item via mg, returning McHD or McEN.
+func (c *Client) MetaTouch(key string, ttl uint32) (code McCode, err error) {
+	r := MetaResponse{}
+	if err = c.metaSync(key, MetaFlags{}.WithTTL(ttl), &r); err != nil {
+		return 0, err
+	}
+	return r.Code, nil
+}
+
+// metaSync sends an mg and waits for its response.
+func (c *Client) metaSync(key string, f MetaFlags, r *MetaResponse) error {
+	if c.MetaInflight() != 0 {
+		return ErrInflight
+	}
+	if err := c.MetaGetFlags(key, f); err != nil {
+		return err
+	}
+	return c.MetaReceiveInto(r)
 }
 
 // TODO: helper func for chopping up result?
@@ -322,6 +874,10 @@ func (c *Client) MetaDebug(key string) (err error) {
 		b := c.cn.b
 		b.WriteString("me ")
 		b.WriteString(key)
+		// me takes no flags, so is only tracked by position.
+		if c.AutoOpaque {
+			c.pushInflight(MetaRequest{Cmd: "me", Key: key})
+		}
 		b.WriteString("\r\n")
 
 		return nil
@@ -334,6 +890,13 @@ func (c *Client) MetaDebug(key string) (err error) {
 //////////////////////////////////////////////
 
 func (c *Client) Get(key string) (flags uint64, value []byte, code McCode, err error) {
+	return c.GetInto(key, nil)
+}
+
+// GetInto is Get reading the value into buf, which is grown if too small.
+// The returned value shares buf's memory, so reusing buf for every call
+// makes hits allocation free.
+func (c *Client) GetInto(key string, buf []byte) (flags uint64, value []byte, code McCode, err error) {
 	pipelines := c.pipelines
 	// Expected key from response
 	respKey := key
@@ -353,72 +916,307 @@ func (c *Client) Get(key string) (flags uint64, value []byte, code McCode, err e
 			return err
 		}
 
+		// Errors that leave the stream in sync are held until every
+		// pipelined response has been read; the rest drop the connection.
+		var rerr error
 		for i := 0; i < pipelines; i++ {
-			line, err := b.ReadBytes('\n')
+			line, err := readLine(b.Reader, c.rline)
+			c.rline = line
 			if err != nil {
 				return err
 			}
 
 			if bytes.Equal(line, []byte("END\r\n")) {
 				code = McMISS
-			} else {
-				parts := bytes.Split(line[:len(line)-2], []byte(" "))
-				if !bytes.Equal(parts[0], []byte("VALUE")) {
-					// TODO: This should look for ERROR/SERVER_ERROR/etc
-					fmt.Print("Unexpected Response: ", string(line), "\n")
-					continue
-				}
-				if len(parts) != 4 {
-					fmt.Print("Unexpected Response: ", "parts not 4", "\n")
-					continue
+				continue
+			}
+			if !bytes.HasPrefix(line, []byte("VALUE ")) {
+				err := textError(line)
+				if isConnErr(err) {
+					return err
 				}
-				if !bytes.Equal(parts[1], []byte(respKey)) {
-					fmt.Print("Unmatched Key: ", string(parts[1]), " and ", respKey, "\n")
-					// FIXME: how do we embed the received vs expected in here?
-					// use the brand-new golang error wrapping thing?
-					continue
+				if rerr == nil {
+					rerr = err
 				}
-				flags, _ = ParseUint(parts[2])
-				size, _ := ParseUint(parts[3])
+				continue
+			}
+			rkey, rflags, size, _, err := parseValueLine(line, false)
+			if err != nil {
+				return err
+			}
+			// rkey points into the line buffer, which END is read into
+			// next.
+			keyMatch := string(rkey) == respKey
 
-				value = make([]byte, size+2)
-				_, err := io.ReadFull(b, value)
-				if err != nil {
-					fmt.Print("io ReadFull error, return", "\n")
-					return err
-				}
+			if uint64(cap(buf)) < size+2 {
+				buf = make([]byte, size+2)
+			}
+			rvalue := buf[:size+2]
+			if _, err := io.ReadFull(b, rvalue); err != nil {
+				return err
+			}
+			if !bytes.Equal(rvalue[len(rvalue)-2:], []byte("\r\n")) {
+				return ErrCorruptValue
+			}
 
-				if !bytes.Equal(value[len(value)-2:], []byte("\r\n")) {
-					fmt.Print("Unmatched Value", "\n")
-					continue
-				}
-				code = McHIT
-				value = value[:size]
+			line, err = readLine(b.Reader, c.rline)
+			c.rline = line
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(line, []byte("END\r\n")) {
+				return ErrUnexpectedResponse
+			}
 
-				line, err = b.ReadBytes('\n')
-				if !bytes.Equal(line, []byte("END\r\n")) {
-					fmt.Print("Unmatched Reponse: ", string(line), " is not END\r\n")
-					continue
+			if !keyMatch {
+				if rerr == nil {
+					rerr = ErrKeyDoesNotMatch
 				}
+				continue
 			}
+			flags = rflags
+			value = rvalue[:size]
+			code = McHIT
 		}
 
-		return nil
+		return rerr
 	})
 	return
 }
 
+// GetResult is the outcome for one key of a GetMulti or GetsMulti.
+type GetResult struct {
+	Code  McCode // McHIT or McMISS
+	Flags uint64
+	CAS   uint64 // gets only
+	Value []byte
+}
+
+// parseValueLine splits up "VALUE key flags bytes [cas]\r\n".
+func parseValueLine(line []byte, withCAS bool) (key []byte, flags uint64, size uint64, cas uint64, err error) {
+	if len(line) < 2 {
+		return nil, 0, 0, 0, ErrUnexpectedResponse
+	}
+	// split by hand; bytes.Split allocates.
+	var parts [5][]byte
+	n := 0
+	for rest := line[:len(line)-2]; ; {
+		if n == len(parts) {
+			return nil, 0, 0, 0, ErrUnexpectedResponse
+		}
+		i := bytes.IndexByte(rest, ' ')
+		if i == -1 {
+			parts[n] = rest
+			n++
+			break
+		}
+		parts[n] = rest[:i]
+		n++
+		rest = rest[i+1:]
+	}
+	want := 4
+	if withCAS {
+		want = 5
+	}
+	if n != want || !bytes.Equal(parts[0], []byte("VALUE")) {
+		return nil, 0, 0, 0, ErrUnexpectedResponse
+	}
+	key = parts[1]
+	if flags, err = parseMetaUint(parts[2]); err != nil {
+		return nil, 0, 0, 0, ErrUnexpectedResponse
+	}
+	if size, err = parseMetaUint(parts[3]); err != nil {
+		return nil, 0, 0, 0, ErrUnexpectedResponse
+	}
+	if withCAS {
+		if cas, err = parseMetaUint(parts[4]); err != nil {
+			return nil, 0, 0, 0, ErrUnexpectedResponse
+		}
+	}
+	return key, flags, size, cas, nil
+}
+
+// readValue reads a value of size bytes plus the trailing \r\n.
+func readValue(b *bufio.ReadWriter, size uint64) ([]byte, error) {
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(b, value); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(value[size:], []byte("\r\n")) {
+		return nil, ErrCorruptValue
+	}
+	return value[:size], nil
+}
+
+// readLine reads a line, \n included, into buf. Unlike ReadBytes it
+// doesn't allocate once buf is big enough.
+func readLine(r *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for {
+		frag, err := r.ReadSlice('\n')
+		buf = append(buf, frag...)
+		if err != bufio.ErrBufferFull {
+			return buf, err
+		}
+	}
+}
+
+// textError turns a text protocol error line into an error.
+func textError(line []byte) error {
+	switch {
+	case bytes.HasPrefix(line, []byte("SERVER_ERROR")):
+		return fmt.Errorf("%w: %s", ErrServerError, bytes.TrimSpace(line[12:]))
+	case bytes.HasPrefix(line, []byte("CLIENT_ERROR")):
+		return fmt.Errorf("%w: %s", ErrClientError, bytes.TrimSpace(line[12:]))
+	case bytes.Equal(line, []byte("ERROR\r\n")):
+		return ErrUnknownCommand
+	}
+	return ErrUnexpectedResponse
+}
+
+// GetMulti fetches all keys with a single get. Results line up with keys.
+// Hits must come back in the order requested and only for keys asked for,
+// else ErrKeyDoesNotMatch is returned once the response has been read.
+func (c *Client) GetMulti(keys []string) (results []GetResult, err error) {
+	return c.getMulti("get ", keys, false)
+}
+
+// GetsMulti is GetMulti with CAS values.
+func (c *Client) GetsMulti(keys []string) (results []GetResult, err error) {
+	return c.getMulti("gets ", keys, true)
+}
+
+func (c *Client) getMulti(cmd string, keys []string, withCAS bool) (results []GetResult, err error) {
+	avail := len(cmd) + 2
+	for _, key := range keys {
+		if len(key) > 250 {
+			return nil, ErrKeyTooLong
+		}
+		avail += len(key) + 1
+	}
+
+	results = make([]GetResult, len(keys))
+	for i := range results {
+		results[i].Code = McMISS
+	}
+
+	err = c.runNow("", avail, func() error {
+		b := c.cn.b
+		b.WriteString(cmd)
+		for i, key := range keys {
+			if i != 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(key)
+		}
+		b.WriteString("\r\n")
+		if err := b.Flush(); err != nil {
+			return err
+		}
+
+		// Hits come back in request order with misses left out, so walk
+		// forward through keys as responses arrive.
+		next := 0
+		var mismatch error
+		for {
+			line, err := b.ReadBytes('\n')
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, []byte("END\r\n")) {
+				return mismatch
+			}
+			if !bytes.HasPrefix(line, []byte("VALUE ")) {
+				return textError(line)
+			}
+
+			rkey, flags, size, cas, err := parseValueLine(line, withCAS)
+			if err != nil {
+				return err
+			}
+			value, err := readValue(b, size)
+			if err != nil {
+				return err
+			}
+
+			found := false
+			for ; next < len(keys); next++ {
+				respKey := keys[next]
+				if c.stripKeyPrefix {
+					respKey = strings.TrimPrefix(respKey, c.keyPrefix)
+				}
+				if string(rkey) == respKey {
+					found = true
+					break
+				}
+			}
+			if !found {
+				// Keep reading to END so the connection stays usable.
+				mismatch = ErrKeyDoesNotMatch
+				continue
+			}
+			results[next] = GetResult{Code: McHIT, Flags: flags, CAS: cas, Value: value}
+			next++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 func (c *Client) Set(key string, flags uint32, expiration uint32, value []byte) (code McCode, err error) {
-	err = c.runNow(key, len(key)+6+len(value), func() error {
+	return c.store("set ", key, flags, expiration, 0, value)
+}
+
+// Add stores value only if the key doesn't exist yet, else McNOT_STORED.
+func (c *Client) Add(key string, flags uint32, expiration uint32, value []byte) (code McCode, err error) {
+	return c.store("add ", key, flags, expiration, 0, value)
+}
+
+// Replace stores value only if the key exists, else McNOT_STORED.
+func (c *Client) Replace(key string, flags uint32, expiration uint32, value []byte) (code McCode, err error) {
+	return c.store("replace ", key, flags, expiration, 0, value)
+}
+
+// Append adds value to the end of an existing item, else McNOT_STORED.
+// flags and expiration are ignored by the server but still sent.
+func (c *Client) Append(key string, flags uint32, expiration uint32, value []byte) (code McCode, err error) {
+	return c.store("append ", key, flags, expiration, 0, value)
+}
+
+// Prepend adds value to the start of an existing item, else McNOT_STORED.
+func (c *Client) Prepend(key string, flags uint32, expiration uint32, value []byte) (code McCode, err error) {
+	return c.store("prepend ", key, flags, expiration, 0, value)
+}
+
+// Cas stores value only if the item's CAS still matches, returning
+// McSTORED, McEXISTS if it was modified since, or McNOT_FOUND.
+func (c *Client) Cas(key string, flags uint32, expiration uint32, cas uint64, value []byte) (code McCode, err error) {
+	return c.store("cas ", key, flags, expiration, cas, value)
+}
+
+// store runs a text storage command. cas is only sent for the cas command.
+// With NoReply set the request is flushed without waiting, and code is 0.
+func (c *Client) store(cmd string, key string, flags uint32, expiration uint32, cas uint64, value []byte) (code McCode, err error) {
+	// command, key, and up to four numbers with spaces.
+	err = c.runNow(key, len(cmd)+len(key)+len(value)+90, func() error {
 		b := c.cn.b
-		b.WriteString("set ")
+		b.WriteString(cmd)
 		b.WriteString(key)
 		b.WriteString(" ")
-		b.WriteString(strconv.FormatUint(uint64(flags), 10))
+		writeUint(b.Writer, uint64(flags))
 		b.WriteString(" ")
-		b.WriteString(strconv.FormatUint(uint64(expiration), 10))
+		writeUint(b.Writer, uint64(expiration))
 		b.WriteString(" ")
-		b.WriteString(strconv.FormatUint(uint64(len(value)), 10))
+		writeUint(b.Writer, uint64(len(value)))
+		if cmd == "cas " {
+			b.WriteString(" ")
+			writeUint(b.Writer, cas)
+		}
+		if c.NoReply {
+			b.WriteString(" noreply")
+		}
 		b.WriteString("\r\n")
 		_, err := b.Write(value)
 		if err != nil {
@@ -427,7 +1225,7 @@ func (c *Client) Set(key string, flags uint32, expiration uint32, value []byte)
 		b.WriteString("\r\n")
 		err = b.Flush()
 
-		if err != nil {
+		if err != nil || c.NoReply {
 			return err
 		}
 
@@ -436,14 +1234,20 @@ func (c *Client) Set(key string, flags uint32, expiration uint32, value []byte)
 			return err
 		}
 
-		if bytes.Equal(line, []byte("STORED\r\n")) {
+		switch string(line) {
+		case "STORED\r\n":
 			code = McSTORED
-		} else if bytes.HasPrefix(line, []byte("SERVER_ERROR")) {
-			// usually this is an OOM
-			// TODO: error wrapping.
-			return ErrServerError
-		} else {
-			// TODO: error wrapping
+		case "NOT_STORED\r\n":
+			code = McNOT_STORED
+		case "EXISTS\r\n":
+			code = McEXISTS
+		case "NOT_FOUND\r\n":
+			code = McNOT_FOUND
+		default:
+			if bytes.HasPrefix(line, []byte("SERVER_ERROR")) {
+				// usually this is an OOM
+				return textError(line)
+			}
 			fmt.Printf("Got instead of STORED: %s\n", string(line))
 			return ErrUnexpectedResponse
 		}
@@ -453,6 +1257,16 @@ func (c *Client) Set(key string, flags uint32, expiration uint32, value []byte)
 	return
 }
 
+// Gets is a single key GetMulti, returning the CAS for use with Cas.
+func (c *Client) Gets(key string) (flags uint64, value []byte, cas uint64, code McCode, err error) {
+	res, err := c.getMulti("gets ", []string{key}, true)
+	if err != nil {
+		return 0, nil, 0, 0, err
+	}
+	r := res[0]
+	return r.Flags, r.Value, r.CAS, r.Code, nil
+}
+
 func (c *Client) Delete(key string) (code McCode, err error) {
 	err = c.runNow(key, len(key)+6, func() error {
 		b := c.cn.b
@@ -483,6 +1297,60 @@ func (c *Client) Delete(key string) (code McCode, err error) {
 	return
 }
 
+// Touch updates the TTL of an item without fetching it.
+func (c *Client) Touch(key string, expiration uint32) (code McCode, err error) {
+	err = c.runNow(key, len(key)+18, func() error {
+		b := c.cn.b
+		b.WriteString("touch ")
+		b.WriteString(key)
+		b.WriteString(" ")
+		writeUint(b.Writer, uint64(expiration))
+		b.WriteString("\r\n")
+		err = b.Flush()
+
+		if err != nil {
+			return err
+		}
+
+		line, err := b.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(line, []byte("TOUCHED\r\n")) {
+			code = McTOUCHED
+		} else if bytes.Equal(line, []byte("NOT_FOUND\r\n")) {
+			code = McNOT_FOUND
+		} else {
+			return ErrUnexpectedResponse
+		}
+
+		return nil
+	})
+	return
+}
+
+// Gat fetches an item and updates its TTL in one go.
+func (c *Client) Gat(key string, expiration uint32) (flags uint64, value []byte, code McCode, err error) {
+	flags, value, _, code, err = c.gat("gat ", key, expiration, false)
+	return
+}
+
+// Gats is Gat which also returns the CAS.
+func (c *Client) Gats(key string, expiration uint32) (flags uint64, value []byte, cas uint64, code McCode, err error) {
+	return c.gat("gats ", key, expiration, true)
+}
+
+func (c *Client) gat(cmd string, key string, expiration uint32, withCAS bool) (flags uint64, value []byte, cas uint64, code McCode, err error) {
+	cmd += strconv.FormatUint(uint64(expiration), 10) + " "
+	res, err := c.getMulti(cmd, []string{key}, withCAS)
+	if err != nil {
+		return 0, nil, 0, 0, err
+	}
+	r := res[0]
+	return r.Flags, r.Value, r.CAS, r.Code, nil
+}
+
 func (c *Client) Incr(key string, delta uint64) (result uint64, code McCode, err error) {
 	number := strconv.FormatUint(delta, 10)
 	err = c.runNow(key, len(key)+len(number)+8, func() error {
@@ -568,8 +1436,6 @@ func (c *Client) Decr(key string, delta uint64) (result uint64, code McCode, err
 // Debating if the other interfaces should use these structs... they should be
 // passed in rather than generated internally.
 // Also; should we be using a static byte buffer for key?
-// not much to be done about the garbage generated by value, we can slice into
-// what's generated by receiving data at least.
 type Item struct {
 	Key        string
 	Value      []byte
@@ -577,6 +1443,7 @@ type Item struct {
 	Flags      uint32
 	CAS        uint64
 	Opaque     uint32
+	Number     uint64 // result of a binary incr/decr
 }
 
 var zeroItem = &Item{}
@@ -628,6 +1495,8 @@ const (
 	McOP_APPENDQ    = 0x19
 	McOP_PREPENDQ   = 0x1a
 	McOP_TOUCH      = 0x1c
+	McOP_GAT        = 0x1d
+	McOP_GATQ       = 0x1e
 )
 
 var (
@@ -641,8 +1510,8 @@ var (
 		0x005: ErrItemNotStored,
 		0x006: errors.New("Incr/Decr on non-numeric value"),
 		0x007: errors.New("The vbucket belongs to another server"),
-		0x008: errors.New("Authentication error"),
-		0x009: errors.New("Authentication continue"),
+		0x008: ErrAuthFailed,
+		0x009: ErrAuthContinue,
 		0x081: errors.New("Unknown command"),
 		0x082: errors.New("Out of memory"),
 		0x083: errors.New("Not supported"),
@@ -665,9 +1534,8 @@ type header struct {
 	cas          uint64
 }
 
-func (hdr *header) read(reader io.Reader) error {
-	// FIXME: stack var array?
-	hdrBuf := make([]byte, hdrSize)
+// read parses a header, using hdrBuf (hdrSize bytes) as scratch space.
+func (hdr *header) read(reader io.Reader, hdrBuf []byte) error {
 	if n, err := io.ReadFull(reader, hdrBuf); err != nil || n != hdrSize {
 		return err
 	}
@@ -701,18 +1569,31 @@ type packet struct {
 	extras []byte
 	key    string
 	value  []byte
+	// reused between packets; extras and value read in point into rbuf,
+	// extras written out come from ebuf.
+	hbuf    [24]byte
+	ebuf    [20]byte
+	rbuf    []byte
+	wbuf    []byte
+	lastKey string
 }
 
 // wipe your packet header with minimal garbage with this one ... weird trick.
 var zeropacket = &packet{}
 
+// Reset clears the packet, keeping its buffers.
 func (pkt *packet) Reset() {
+	rbuf, wbuf, lastKey := pkt.rbuf, pkt.wbuf, pkt.lastKey
 	*pkt = *zeropacket
+	pkt.rbuf, pkt.wbuf, pkt.lastKey = rbuf, wbuf, lastKey
 }
 
-// FIXME: too much garbage.
 func (pkt *packet) write(writer io.Writer) error {
-	buf := make([]byte, hdrSize, uint32(hdrSize)+pkt.bodyLength)
+	size := uint32(hdrSize) + pkt.bodyLength
+	if uint32(cap(pkt.wbuf)) < size {
+		pkt.wbuf = make([]byte, 0, size)
+	}
+	buf := pkt.wbuf[:hdrSize]
 	// if err := binary.Write(buffer, binary.BigEndian, pkt.header); err != nil {
 	// return err
 	// }
@@ -725,19 +1606,26 @@ func (pkt *packet) write(writer io.Writer) error {
 }
 
 func (pkt *packet) read(reader io.Reader) error {
-	if err := pkt.header.read(reader); err != nil {
+	if err := pkt.header.read(reader, pkt.hbuf[:hdrSize]); err != nil {
 		return err
 	}
 	// if err := binary.Read(reader, binary.BigEndian, &pkt.header); err != nil {
 	// return err
 	// }
-	body := make([]byte, pkt.bodyLength)
+	if uint32(cap(pkt.rbuf)) < pkt.bodyLength {
+		pkt.rbuf = make([]byte, pkt.bodyLength)
+	}
+	body := pkt.rbuf[:pkt.bodyLength]
 	if n, err := io.ReadFull(reader, body); err != nil || uint32(n) != pkt.bodyLength {
 		return err
 	}
 	keyOffset := uint16(pkt.extrasLength) + pkt.keyLength
 	if pkt.keyLength != 0 {
-		pkt.key = string(body[pkt.extrasLength:keyOffset])
+		// Responses tend to repeat keys; only make a new string on change.
+		if k := body[pkt.extrasLength:keyOffset]; string(k) != pkt.lastKey {
+			pkt.lastKey = string(k)
+		}
+		pkt.key = pkt.lastKey
 	}
 	if pkt.bodyLength-uint32(keyOffset) != 0 {
 		pkt.value = body[keyOffset:]
@@ -763,14 +1651,10 @@ func (c *Client) runBin(key string, avail int, fn func(pkt *packet) error) (opaq
 		return 0, ErrKeyTooLong
 	}
 
-	if c.cn == nil {
-		cn, err := c.connectToMc()
-		if err != nil {
-			fmt.Println("FAILED TO CONNECT")
-			return 0, err
-		}
-		c.cn = cn
+	if err := c.connect(); err != nil {
+		return 0, err
 	}
+	defer func() { err = c.connErr(err) }()
 
 	b := c.cn.b
 	// To avoid checking errors a bunch of times, ensure there's enough space
@@ -823,18 +1707,43 @@ func (c *Client) BinGet(key string) (opaque uint32, err error) {
 }
 
 func (c *Client) BinSet(item *Item) (opaque uint32, err error) {
+	return c.binStore(McOP_SET, item)
+}
+
+func (c *Client) BinSetQ(item *Item) (opaque uint32, err error) {
+	return c.binStore(McOP_SETQ, item)
+}
+
+func (c *Client) BinAdd(item *Item) (opaque uint32, err error) {
+	return c.binStore(McOP_ADD, item)
+}
+
+func (c *Client) BinAddQ(item *Item) (opaque uint32, err error) {
+	return c.binStore(McOP_ADDQ, item)
+}
+
+func (c *Client) BinReplace(item *Item) (opaque uint32, err error) {
+	return c.binStore(McOP_REPLACE, item)
+}
+
+func (c *Client) BinReplaceQ(item *Item) (opaque uint32, err error) {
+	return c.binStore(McOP_REPLACEQ, item)
+}
+
+// set/add/replace all carry flags and expiration in the extras.
+func (c *Client) binStore(opcode uint8, item *Item) (opaque uint32, err error) {
 	opaque, err = c.runBin(item.Key, len(item.Key)+len(item.Value)+48, func(pkt *packet) error {
 		pkt.key = item.Key
 		pkt.value = item.Value
 		pkt.cas = item.CAS
 		extrasLength := 8
 
-		pkt.extras = make([]byte, extrasLength)
+		pkt.extras = pkt.ebuf[:extrasLength]
 		pkt.extrasLength = uint8(extrasLength)
 		binary.BigEndian.PutUint32(pkt.extras[:4], item.Flags)
 		binary.BigEndian.PutUint32(pkt.extras[4:], item.Expiration)
 
-		pkt.header.opcode = uint8(McOP_SET)
+		pkt.header.opcode = opcode
 		pkt.header.keyLength = uint16(len(item.Key))
 		pkt.header.bodyLength = uint32(pkt.keyLength) + uint32(len(pkt.value)) + uint32(extrasLength)
 		return nil
@@ -842,19 +1751,168 @@ func (c *Client) BinSet(item *Item) (opaque uint32, err error) {
 	return
 }
 
+func (c *Client) BinAppend(item *Item) (opaque uint32, err error) {
+	return c.binConcat(McOP_APPEND, item)
+}
+
+func (c *Client) BinAppendQ(item *Item) (opaque uint32, err error) {
+	return c.binConcat(McOP_APPENDQ, item)
+}
+
+func (c *Client) BinPrepend(item *Item) (opaque uint32, err error) {
+	return c.binConcat(McOP_PREPEND, item)
+}
+
+func (c *Client) BinPrependQ(item *Item) (opaque uint32, err error) {
+	return c.binConcat(McOP_PREPENDQ, item)
+}
+
+// append/prepend take no extras.
+func (c *Client) binConcat(opcode uint8, item *Item) (opaque uint32, err error) {
+	opaque, err = c.runBin(item.Key, len(item.Key)+len(item.Value)+48, func(pkt *packet) error {
+		pkt.key = item.Key
+		pkt.value = item.Value
+		pkt.cas = item.CAS
+
+		pkt.header.opcode = opcode
+		pkt.header.keyLength = uint16(len(item.Key))
+		pkt.header.bodyLength = uint32(pkt.keyLength) + uint32(len(pkt.value))
+		return nil
+	})
+	return
+}
+
+// BinDelete removes item.Key, only if item.CAS matches when non-zero.
+func (c *Client) BinDelete(item *Item) (opaque uint32, err error) {
+	return c.binKeyOnly(McOP_DELETE, item.Key, item.CAS)
+}
+
+func (c *Client) BinDeleteQ(item *Item) (opaque uint32, err error) {
+	return c.binKeyOnly(McOP_DELETEQ, item.Key, item.CAS)
+}
+
+// BinGetQ is a quiet BinGet: misses get no response. Returns the key.
+func (c *Client) BinGetQ(key string) (opaque uint32, err error) {
+	return c.binKeyOnly(McOP_GETKQ, key, 0)
+}
+
+// BinStat asks for stats, with key as an optional group (ie; "settings").
+// The response is one packet per stat; see BinReceiveStats.
+func (c *Client) BinStat(key string) (opaque uint32, err error) {
+	return c.binKeyOnly(McOP_STAT, key, 0)
+}
+
+func (c *Client) BinNoop() (opaque uint32, err error) {
+	return c.binKeyOnly(McOP_NOOP, "", 0)
+}
+
+func (c *Client) BinVersion() (opaque uint32, err error) {
+	return c.binKeyOnly(McOP_VERSION, "", 0)
+}
+
+func (c *Client) binKeyOnly(opcode uint8, key string, cas uint64) (opaque uint32, err error) {
+	opaque, err = c.runBin(key, len(key)+48, func(pkt *packet) error {
+		pkt.key = key
+		pkt.cas = cas
+
+		pkt.header.opcode = opcode
+		pkt.header.keyLength = uint16(len(key))
+		pkt.header.bodyLength = uint32(len(key))
+		return nil
+	})
+	return
+}
+
+// BinIncrement adds delta to a counter. If the key is missing it's created
+// with initial, unless expiration is 0xffffffff. Read the result from
+// Item.Number.
+func (c *Client) BinIncrement(key string, delta uint64, initial uint64, expiration uint32) (opaque uint32, err error) {
+	return c.binArith(McOP_INCREMENT, key, delta, initial, expiration)
+}
+
+func (c *Client) BinIncrementQ(key string, delta uint64, initial uint64, expiration uint32) (opaque uint32, err error) {
+	return c.binArith(McOP_INCREMENTQ, key, delta, initial, expiration)
+}
+
+func (c *Client) BinDecrement(key string, delta uint64, initial uint64, expiration uint32) (opaque uint32, err error) {
+	return c.binArith(McOP_DECREMENT, key, delta, initial, expiration)
+}
+
+func (c *Client) BinDecrementQ(key string, delta uint64, initial uint64, expiration uint32) (opaque uint32, err error) {
+	return c.binArith(McOP_DECREMENTQ, key, delta, initial, expiration)
+}
+
+func (c *Client) binArith(opcode uint8, key string, delta uint64, initial uint64, expiration uint32) (opaque uint32, err error) {
+	opaque, err = c.runBin(key, len(key)+48, func(pkt *packet) error {
+		pkt.key = key
+		extrasLength := 20
+
+		pkt.extras = pkt.ebuf[:extrasLength]
+		pkt.extrasLength = uint8(extrasLength)
+		binary.BigEndian.PutUint64(pkt.extras[:8], delta)
+		binary.BigEndian.PutUint64(pkt.extras[8:16], initial)
+		binary.BigEndian.PutUint32(pkt.extras[16:], expiration)
+
+		pkt.header.opcode = opcode
+		pkt.header.keyLength = uint16(len(key))
+		pkt.header.bodyLength = uint32(pkt.keyLength) + uint32(extrasLength)
+		return nil
+	})
+	return
+}
+
+// BinFlushAll invalidates all items, after delay seconds if non-zero.
+// Not to be confused with BinFlush, which flushes our write buffer.
+func (c *Client) BinFlushAll(delay uint32) (opaque uint32, err error) {
+	return c.binFlushAll(McOP_FLUSH, delay)
+}
+
+func (c *Client) BinFlushAllQ(delay uint32) (opaque uint32, err error) {
+	return c.binFlushAll(McOP_FLUSHQ, delay)
+}
+
+func (c *Client) binFlushAll(opcode uint8, delay uint32) (opaque uint32, err error) {
+	opaque, err = c.runBin("", 48, func(pkt *packet) error {
+		pkt.header.opcode = opcode
+		if delay != 0 {
+			extrasLength := 4
+			pkt.extras = pkt.ebuf[:extrasLength]
+			pkt.extrasLength = uint8(extrasLength)
+			binary.BigEndian.PutUint32(pkt.extras, delay)
+			pkt.header.bodyLength = uint32(extrasLength)
+		}
+		return nil
+	})
+	return
+}
+
+// BinGat fetches item.Key and updates its TTL to item.Expiration.
+func (c *Client) BinGat(item *Item) (opaque uint32, err error) {
+	return c.binTouch(McOP_GAT, item)
+}
+
+// BinGatQ is a quiet BinGat: misses get no response.
+func (c *Client) BinGatQ(item *Item) (opaque uint32, err error) {
+	return c.binTouch(McOP_GATQ, item)
+}
+
 func (c *Client) BinTouch(item *Item) (opaque uint32, err error) {
+	return c.binTouch(McOP_TOUCH, item)
+}
+
+// touch and the gat family share the same request layout.
+func (c *Client) binTouch(opcode uint8, item *Item) (opaque uint32, err error) {
 	opaque, err = c.runBin(item.Key, len(item.Key)+48, func(pkt *packet) error {
 		pkt.key = item.Key
 		pkt.cas = item.CAS
 		extrasLength := 4
 
-		// pretty sure this is garbage waste; can keep a static 48 byte buffer.
-		pkt.extras = make([]byte, extrasLength)
+		pkt.extras = pkt.ebuf[:extrasLength]
 		pkt.extrasLength = uint8(extrasLength)
 
 		binary.BigEndian.PutUint32(pkt.extras[:4], item.Expiration)
 
-		pkt.header.opcode = uint8(McOP_TOUCH)
+		pkt.header.opcode = opcode
 		pkt.header.keyLength = uint16(len(item.Key))
 		pkt.header.bodyLength = uint32(pkt.keyLength) + uint32(extrasLength)
 		return nil
@@ -883,15 +1941,35 @@ func (c *Client) BinQuitQ() (opaque uint32, err error) {
 // This _could_ just be Flush() and shared, but there might be reasons to hook
 // something protocol specific in here.
 func (c *Client) BinFlush() (err error) {
+	if c.cn == nil {
+		return ErrNotConnected
+	}
+	if err := c.refreshDeadline(); err != nil {
+		return err
+	}
 	b := c.cn.b
 	err = b.Flush()
-	return err
+	return c.connErr(err)
 }
 
 // don't run this without anything in the queue :P
 func (c *Client) BinReceive(item *Item) (opcode uint8, code McCode, err error) {
-	b := c.cn.b
+	return c.BinReceiveInto(item, nil)
+}
+
+// BinReceiveInto is BinReceive copying any value into buf, which is grown
+// if too small. item.Value shares buf's memory, so reusing buf for every
+// call makes responses allocation free.
+func (c *Client) BinReceiveInto(item *Item, buf []byte) (opcode uint8, code McCode, err error) {
 	item.Reset()
+	if c.cn == nil {
+		return 0xff, McCHECK_ERROR, ErrNotConnected
+	}
+	if err := c.refreshDeadline(); err != nil {
+		return 0xff, McCHECK_ERROR, err
+	}
+	defer func() { err = c.connErr(err) }()
+	b := c.cn.b
 	// Flush if there's anything in the write queue.
 	// Simplifies the API slightly.
 	// This wouldn't be ideal if someone were queueing work, then want to come
@@ -903,6 +1981,9 @@ func (c *Client) BinReceive(item *Item) (opcode uint8, code McCode, err error) {
 	}
 
 	pkt := c.binpkt
+	// Empty fields aren't written by read, so don't let the last packet's
+	// linger.
+	pkt.Reset()
 	err = pkt.read(b)
 	item.Opaque = pkt.opaque
 	if err != nil {
@@ -950,13 +2031,17 @@ func (c *Client) BinReceive(item *Item) (opcode uint8, code McCode, err error) {
 	case McOP_GETK:
 		fallthrough
 	case McOP_GETKQ:
+		fallthrough
+	case McOP_GAT:
+		fallthrough
+	case McOP_GATQ:
 		if pkt.value != nil {
 			var flags uint32
 			if pkt.extras != nil {
 				flags = binary.BigEndian.Uint32(pkt.extras)
 			}
 			item.Key = pkt.key
-			item.Value = pkt.value
+			item.Value = append(buf[:0], pkt.value...)
 			item.Flags = flags
 			item.CAS = pkt.cas
 		}
@@ -971,9 +2056,54 @@ func (c *Client) BinReceive(item *Item) (opcode uint8, code McCode, err error) {
 	case McOP_TOUCH:
 		// might... not actually set the CAS, should check.
 		item.CAS = pkt.cas
+	case McOP_INCREMENT:
+		fallthrough
+	case McOP_INCREMENTQ:
+		fallthrough
+	case McOP_DECREMENT:
+		fallthrough
+	case McOP_DECREMENTQ:
+		// new value as a 64bit number in the body.
+		if len(pkt.value) != 8 {
+			return pkt.header.opcode, McCHECK_ERROR, ErrCorruptValue
+		}
+		item.Number = binary.BigEndian.Uint64(pkt.value)
+		item.CAS = pkt.cas
+	case McOP_VERSION:
+		item.Value = append(buf[:0], pkt.value...)
+	case McOP_STAT:
+		// one packet per stat, ending with an empty key.
+		item.Key = pkt.key
+		item.Value = append(buf[:0], pkt.value...)
+	case McOP_NOOP:
+		fallthrough
+	case McOP_FLUSH:
+		fallthrough
+	case McOP_FLUSHQ:
+		// nothing to see here.
 	default:
 		return pkt.header.opcode, McCHECK_ERROR, ErrUnknownStatus
 	}
 
 	return pkt.header.opcode, McOK, nil
 }
+
+// BinReceiveStats reads the packets for a BinStat up to the terminating
+// empty one.
+func (c *Client) BinReceiveStats() (stats Stats, err error) {
+	item := &Item{}
+	stats = make(Stats)
+	for {
+		opcode, _, err := c.BinReceive(item)
+		if err != nil {
+			return nil, err
+		}
+		if opcode != McOP_STAT {
+			return nil, ErrUnexpectedResponse
+		}
+		if item.Key == "" {
+			return stats, nil
+		}
+		stats[item.Key] = string(item.Value)
+	}
+}
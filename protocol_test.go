@@ -1,7 +1,15 @@
 package mctester
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,7 +25,11 @@ const keyPrefix = "mctester:"
 const stripKeyPrefix = false
 
 func newcli() *Client {
-	mc := NewClient(hostname, socket, pipelines, keyPrefix, stripKeyPrefix)
+	return newcliHost(hostname)
+}
+
+func newcliHost(host string) *Client {
+	mc := NewClient(host, socket, pipelines, keyPrefix, stripKeyPrefix)
 	mc.ConnectTimeout = 3 * time.Second
 	mc.NetTimeout = time.Second
 	mc.WBufSize = 64 * 1024
@@ -25,6 +37,566 @@ func newcli() *Client {
 	return mc
 }
 
+// fakeServer listens on a random local port and hands each accepted
+// connection to fn. Lets us test response parsing without a memcached.
+func fakeServer(t *testing.T, fn func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fake server listen: %v", err)
+	}
+	return serveFake(t, l, fn)
+}
+
+// serveFake runs fn for each connection accepted on l until the test ends.
+func serveFake(t *testing.T, l net.Listener, fn func(conn net.Conn)) string {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fn(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// cannedServer answers every request line with the next canned response.
+// Value bodies following a set/ms line are skipped.
+func cannedServer(t *testing.T, responses ...string) string {
+	return fakeServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for _, res := range responses {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			if bytes.HasPrefix(line, []byte("ms ")) || bytes.HasPrefix(line, []byte("set ")) {
+				if _, err := r.ReadBytes('\n'); err != nil {
+					return
+				}
+			}
+			if _, err := io.WriteString(conn, res); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, r)
+	})
+}
+
+// scriptServer takes pairs of expected request and response. Requests
+// spanning several lines (ie; with a value) are read line by line. Any
+// request not matching the script fails the test.
+func scriptServer(t *testing.T, script ...string) string {
+	return fakeServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for i := 0; i+1 < len(script); i += 2 {
+			var line string
+			for n := strings.Count(script[i], "\n"); n > 0; n-- {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line += l
+			}
+			if line != script[i] {
+				t.Errorf("fake server expected request %q, got %q", script[i], line)
+				io.WriteString(conn, "ERROR\r\n")
+				return
+			}
+			if _, err := io.WriteString(conn, script[i+1]); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, r)
+	})
+}
+
+func TestMetaResponseFlags(t *testing.T) {
+	mc := newcliHost(cannedServer(t,
+		"VA 4 c123 t-1 s4 f5 kfoo Oabc l30 h1 W X Z\r\nfoop\r\n",
+		"VA 2 t90\r\nhi\r\n",
+		"HD c9 Oq\r\n",
+		"EN\r\n",
+		"VA 1 cfoo\r\nx\r\n",
+	))
+
+	r := &MetaResponse{}
+	if err := mc.MetaGet("foo", "c t s f k Oabc l h v"); err != nil {
+		t.Fatalf("metaget error: %v", err)
+	}
+	if err := mc.MetaReceiveInto(r); err != nil {
+		t.Fatalf("metareceive error: %v", err)
+	}
+	if r.Code != McVA || !bytes.Equal(r.Value, []byte("foop")) {
+		t.Fatalf("bad code or value: %d %q", r.Code, r.Value)
+	}
+	if r.CAS != 123 || r.TTL != -1 || r.Size != 4 || r.ClientFlags != 5 ||
+		string(r.Key) != "foo" || string(r.Opaque) != "abc" ||
+		r.LastAccess != 30 || !r.Fetched || !r.Won || !r.Stale || !r.AlreadyWon {
+		t.Fatalf("bad parsed flags: %+v", r)
+	}
+
+	// reusing the response should clear everything but the value buffer.
+	mc.MetaGet("foo", "t v")
+	if err := mc.MetaReceiveInto(r); err != nil {
+		t.Fatalf("metareceive error: %v", err)
+	}
+	if r.TTL != 90 || r.CAS != 0 || r.Won || string(r.Value) != "hi" {
+		t.Fatalf("response not reset: %+v", r)
+	}
+
+	mc.MetaSet("foo", "c Oq", []byte("hi"))
+	if err := mc.MetaReceiveInto(r); err != nil {
+		t.Fatalf("metareceive error: %v", err)
+	}
+	if r.Code != McHD || r.CAS != 9 || string(r.Opaque) != "q" {
+		t.Fatalf("bad set response: %+v", r)
+	}
+
+	mc.MetaGet("foo", "v")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McEN {
+		t.Fatalf("expected miss: %d %v", r.Code, err)
+	}
+
+	mc.MetaGet("foo", "c v")
+	if err := mc.MetaReceiveInto(r); err != ErrCorruptFlags {
+		t.Fatalf("expected corrupt flags error, got: %v", err)
+	}
+}
+
+func TestMetaStatus(t *testing.T) {
+	tests := []struct {
+		res     string
+		code    McCode
+		value   string
+		message string
+		err     error
+	}{
+		{res: "HD\r\n", code: McHD},
+		{res: "HD c5\r\n", code: McHD},
+		{res: "OK\r\n", code: McOK},
+		{res: "VA 3 c5\r\nfoo\r\n", code: McVA, value: "foo"},
+		{res: "VA 0\r\n\r\n", code: McVA, value: ""},
+		{res: "EN\r\n", code: McEN},
+		{res: "NS\r\n", code: McNS},
+		{res: "EX c5\r\n", code: McEX},
+		{res: "NF\r\n", code: McNF},
+		{res: "MN\r\n", code: McMN},
+		{res: "ME foo exp=-1 la=1 cas=2 fetch=no cls=1 size=63\r\n", code: McME,
+			value: "foo exp=-1 la=1 cas=2 fetch=no cls=1 size=63"},
+		{res: "SERVER_ERROR out of memory storing object\r\n", code: McSE,
+			message: "out of memory storing object"},
+		{res: "CLIENT_ERROR bad command line format\r\n", code: McCL,
+			message: "bad command line format"},
+		{res: "ERROR\r\n", code: McER},
+		{res: "ERROR unknown command\r\n", code: McER, message: "unknown command"},
+		{res: "ZZ\r\n", err: ErrUnknownStatus},
+		{res: "VA 3\r\nfooXX", err: ErrCorruptValue},
+		{res: "VA x\r\n", err: ErrUnexpectedResponse},
+		{res: "HD\n", err: ErrUnexpectedResponse},
+	}
+
+	for _, tt := range tests {
+		mc := newcliHost(cannedServer(t, tt.res))
+		mc.MetaGet("foo", "v")
+		r, err := mc.MetaReceiveResponse()
+		if err != tt.err {
+			t.Fatalf("%q: expected error %v, got %v", tt.res, tt.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if r.Code != tt.code {
+			t.Fatalf("%q: expected code %d, got %d", tt.res, tt.code, r.Code)
+		}
+		if string(r.Value) != tt.value {
+			t.Fatalf("%q: expected value %q, got %q", tt.res, tt.value, r.Value)
+		}
+		if string(r.Message) != tt.message {
+			t.Fatalf("%q: expected message %q, got %q", tt.res, tt.message, r.Message)
+		}
+	}
+}
+
+// A reused response must not read values into memory the previous
+// response's flags still point at.
+func TestMetaResponseReuse(t *testing.T) {
+	mc := newcliHost(cannedServer(t,
+		"ME foo exp=-1 la=1 cas=2 fetch=no cls=1 size=63\r\n",
+		"VA 2 kbarbazqux Oabcdefgh\r\nhi\r\n",
+	))
+	r := &MetaResponse{}
+	mc.MetaDebug("foo")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McME {
+		t.Fatalf("bad debug response: %d %v", r.Code, err)
+	}
+	mc.MetaGet("barbazqux", "k v O")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McVA {
+		t.Fatalf("bad get response: %d %v", r.Code, err)
+	}
+	if string(r.Key) != "barbazqux" || string(r.Opaque) != "abcdefgh" || string(r.Value) != "hi" {
+		t.Fatalf("response corrupted: key %q opaque %q value %q", r.Key, r.Opaque, r.Value)
+	}
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"ma counter MI D1\r\n", "HD\r\n",
+		"ma counter MD D5 v\r\n", "VA 1\r\n7\r\n",
+		"ma counter MI D2 N300 J10 C99 v c\r\n", "VA 2 c100\r\n12\r\n",
+		"ma counter MI D1 C98\r\n", "EX\r\n",
+		"ma nothere MI D1\r\n", "NF\r\n",
+	))
+
+	r := &MetaResponse{}
+	if err := mc.MetaArithmetic("counter", &MetaArith{Delta: 1}, ""); err != nil {
+		t.Fatalf("metaarithmetic error: %v", err)
+	}
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McHD {
+		t.Fatalf("incr: bad response: %d %v", r.Code, err)
+	}
+
+	mc.MetaArithmetic("counter", &MetaArith{Mode: MetaArithDecr, Delta: 5}, "v")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McVA {
+		t.Fatalf("decr: bad response: %d %v", r.Code, err)
+	}
+	if n, err := r.Number(); err != nil || n != 7 {
+		t.Fatalf("decr: bad value: %d %v", n, err)
+	}
+
+	mc.MetaArithmetic("counter", &MetaArith{Delta: 2, Vivify: true, VivifyTTL: 300, Initial: 10, CAS: 99}, "v c")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McVA {
+		t.Fatalf("vivify: bad response: %d %v", r.Code, err)
+	}
+	if n, _ := r.Number(); n != 12 || r.CAS != 100 {
+		t.Fatalf("vivify: bad value or cas: %d %d", n, r.CAS)
+	}
+
+	mc.MetaArithmetic("counter", &MetaArith{Delta: 1, CAS: 98}, "")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McEX {
+		t.Fatalf("cas mismatch: bad response: %d %v", r.Code, err)
+	}
+
+	mc.MetaArithmetic("nothere", &MetaArith{Delta: 1}, "")
+	if err := mc.MetaReceiveInto(r); err != nil || r.Code != McNF {
+		t.Fatalf("miss: bad response: %d %v", r.Code, err)
+	}
+}
+
+func TestNetTimeout(t *testing.T) {
+	var accepts int32
+	host := fakeServer(t, func(conn net.Conn) {
+		// Swallow requests and never answer.
+		atomic.AddInt32(&accepts, 1)
+		io.Copy(io.Discard, conn)
+	})
+	mc := newcliHost(host)
+	mc.NetTimeout = 50 * time.Millisecond
+
+	if _, _, _, err := mc.Get("foo"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("text: expected timeout, got: %v", err)
+	}
+	if mc.cn != nil {
+		t.Fatalf("connection not dropped after timeout")
+	}
+
+	mc.MetaGet("foo", "v")
+	if _, err := mc.MetaReceiveResponse(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("meta: expected timeout, got: %v", err)
+	}
+	if _, err := mc.MetaReceiveResponse(); err != ErrNotConnected {
+		t.Fatalf("meta: expected not connected, got: %v", err)
+	}
+
+	mc.BinGet("foo")
+	if _, _, err := mc.BinReceive(&Item{}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("binary: expected timeout, got: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&accepts); n != 3 {
+		t.Fatalf("expected a reconnect per timeout, got %d connections", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	// Each connection answers one request, then hangs up. The second
+	// connection answers with garbage.
+	var accepts int32
+	host := fakeServer(t, func(conn net.Conn) {
+		n := atomic.AddInt32(&accepts, 1)
+		r := bufio.NewReader(conn)
+		if _, err := r.ReadBytes('\n'); err != nil {
+			return
+		}
+		if n == 2 {
+			io.WriteString(conn, "XX\r\n")
+			io.Copy(io.Discard, r)
+			return
+		}
+		io.WriteString(conn, "HD\r\n")
+	})
+	mc := newcliHost(host)
+	mc.ReconnectBackoff = 20 * time.Millisecond
+
+	mc.MetaDelete("foo", "")
+	if _, err := mc.MetaReceiveResponse(); err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+	mc.MetaDelete("foo", "")
+	if _, err := mc.MetaReceiveResponse(); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+	if mc.Connected() {
+		t.Fatalf("connection not dropped after EOF")
+	}
+
+	start := time.Now()
+	mc.MetaDelete("foo", "")
+	if _, err := mc.MetaReceiveResponse(); err != ErrUnknownStatus {
+		t.Fatalf("expected unknown status, got: %v", err)
+	}
+	if time.Since(start) < mc.ReconnectBackoff {
+		t.Fatalf("reconnected without backing off")
+	}
+	if mc.Connected() {
+		t.Fatalf("connection not dropped after desync")
+	}
+
+	mc.MetaDelete("foo", "")
+	if _, err := mc.MetaReceiveResponse(); err != nil {
+		t.Fatalf("request after reconnect failed: %v", err)
+	}
+
+	st := mc.ConnStats()
+	if st.Connects != 3 || st.Reconnects != 2 || st.Failures != 2 || st.ConnectFailures != 0 {
+		t.Fatalf("bad connection stats: %+v", st)
+	}
+
+	mc.DisableReconnect = true
+	mc.MetaDelete("foo", "")
+	mc.MetaReceiveResponse()
+	if err := mc.MetaDelete("foo", ""); err != ErrDisconnected {
+		t.Fatalf("expected disconnected error, got: %v", err)
+	}
+}
+
+func TestGetDesync(t *testing.T) {
+	tests := []struct {
+		res       string
+		err       error
+		connected bool
+	}{
+		{res: "VALUE foo 0 3\r\nbar\r\nEND\r\n", connected: true},
+		{res: "VALUE foo 0 3\r\nbarXXEND\r\n", err: ErrCorruptValue},
+		{res: "VALUE foo 0 3\r\nbar\r\nVALUE\r\n", err: ErrUnexpectedResponse},
+		{res: "VALUE foo 0\r\n", err: ErrUnexpectedResponse},
+		{res: "XX\r\n", err: ErrUnexpectedResponse},
+		{res: "VALUE bar 0 3\r\nbar\r\nEND\r\n", err: ErrKeyDoesNotMatch, connected: true},
+		{res: "SERVER_ERROR out of memory\r\n", err: ErrServerError, connected: true},
+	}
+	for _, tt := range tests {
+		mc := newcliHost(cannedServer(t, tt.res, "END\r\n"))
+		if _, _, _, err := mc.Get("foo"); !errors.Is(err, tt.err) {
+			t.Fatalf("%q: expected error %v, got %v", tt.res, tt.err, err)
+		}
+		if mc.Connected() != tt.connected {
+			t.Fatalf("%q: expected connected %v", tt.res, tt.connected)
+		}
+		if !tt.connected {
+			continue
+		}
+		// the stream should still be in step.
+		if _, _, code, err := mc.Get("foo"); err != nil || code != McMISS {
+			t.Fatalf("%q: bad get after error: %d %v", tt.res, code, err)
+		}
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"get a b c d\r\n", "VALUE a 0 1\r\n1\r\nVALUE c 5 2\r\nhi\r\nEND\r\n",
+		"gets a b\r\n", "VALUE b 0 1 99\r\nx\r\nEND\r\n",
+		"get a b\r\n", "VALUE b 0 1\r\nx\r\nVALUE a 0 1\r\ny\r\nEND\r\n",
+		"get a\r\n", "VALUE z 0 1\r\nz\r\nEND\r\n",
+		"get a\r\n", "END\r\n",
+	))
+
+	res, err := mc.GetMulti([]string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatalf("getmulti error: %v", err)
+	}
+	codes := []McCode{McHIT, McMISS, McHIT, McMISS}
+	for i, r := range res {
+		if r.Code != codes[i] {
+			t.Fatalf("key %d: expected code %d, got %d", i, codes[i], r.Code)
+		}
+	}
+	if string(res[0].Value) != "1" || string(res[2].Value) != "hi" || res[2].Flags != 5 {
+		t.Fatalf("bad hit results: %+v", res)
+	}
+
+	res, err = mc.GetsMulti([]string{"a", "b"})
+	if err != nil {
+		t.Fatalf("getsmulti error: %v", err)
+	}
+	if res[0].Code != McMISS || res[1].Code != McHIT || res[1].CAS != 99 {
+		t.Fatalf("bad gets results: %+v", res)
+	}
+
+	// out of order, then a key we never asked for.
+	if _, err := mc.GetMulti([]string{"a", "b"}); err != ErrKeyDoesNotMatch {
+		t.Fatalf("expected key mismatch for out of order keys, got: %v", err)
+	}
+	if _, err := mc.GetMulti([]string{"a"}); err != ErrKeyDoesNotMatch {
+		t.Fatalf("expected key mismatch for unknown key, got: %v", err)
+	}
+	// the connection should still be in sync.
+	if res, err := mc.GetMulti([]string{"a"}); err != nil || res[0].Code != McMISS {
+		t.Fatalf("expected miss after mismatch: %+v %v", res, err)
+	}
+}
+
+func TestCas(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"gets foo\r\n", "VALUE foo 3 3 42\r\nbar\r\nEND\r\n",
+		"cas foo 3 60 3 42\r\nbaz\r\n", "STORED\r\n",
+		"cas foo 3 60 3 42\r\nqux\r\n", "EXISTS\r\n",
+		"cas nope 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n",
+		"gets nope\r\n", "END\r\n",
+		"cas foo 0 0 1 1\r\nx\r\n", "SERVER_ERROR out of memory storing object\r\n",
+	))
+
+	flags, v, cas, code, err := mc.Gets("foo")
+	if err != nil || code != McHIT || flags != 3 || cas != 42 || string(v) != "bar" {
+		t.Fatalf("bad gets: %d %q %d %d %v", flags, v, cas, code, err)
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		code  McCode
+	}{
+		{"foo", "baz", McSTORED},
+		{"foo", "qux", McEXISTS},
+	}
+	for _, tt := range tests {
+		code, err := mc.Cas(tt.key, 3, 60, cas, []byte(tt.value))
+		if err != nil || code != tt.code {
+			t.Fatalf("cas %s: expected %d, got %d %v", tt.value, tt.code, code, err)
+		}
+	}
+	if code, err := mc.Cas("nope", 0, 0, 1, []byte("x")); err != nil || code != McNOT_FOUND {
+		t.Fatalf("cas: expected not found, got %d %v", code, err)
+	}
+
+	if _, _, _, code, err := mc.Gets("nope"); err != nil || code != McMISS {
+		t.Fatalf("gets: expected miss, got %d %v", code, err)
+	}
+
+	if _, err := mc.Cas("foo", 0, 0, 1, []byte("x")); !errors.Is(err, ErrServerError) {
+		t.Fatalf("cas: expected server error, got: %v", err)
+	}
+}
+
+func TestStorageCommands(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"add lock 0 30 1\r\n1\r\n", "STORED\r\n",
+		"add lock 0 30 1\r\n1\r\n", "NOT_STORED\r\n",
+		"replace nope 0 0 1\r\nx\r\n", "NOT_STORED\r\n",
+		"replace lock 1 60 1\r\n2\r\n", "STORED\r\n",
+		"append list 0 0 2\r\n,b\r\n", "STORED\r\n",
+		"prepend list 0 0 2\r\na,\r\n", "STORED\r\n",
+		"append nope 0 0 2\r\n,b\r\n", "NOT_STORED\r\n",
+		"set foo 0 0 1 noreply\r\nx\r\n", "",
+		"add foo 0 0 1 noreply\r\nx\r\n", "",
+		"delete foo\r\n", "DELETED\r\n",
+	))
+
+	tests := []struct {
+		fn    func(string, uint32, uint32, []byte) (McCode, error)
+		key   string
+		flags uint32
+		exp   uint32
+		value string
+		code  McCode
+	}{
+		{mc.Add, "lock", 0, 30, "1", McSTORED},
+		{mc.Add, "lock", 0, 30, "1", McNOT_STORED},
+		{mc.Replace, "nope", 0, 0, "x", McNOT_STORED},
+		{mc.Replace, "lock", 1, 60, "2", McSTORED},
+		{mc.Append, "list", 0, 0, ",b", McSTORED},
+		{mc.Prepend, "list", 0, 0, "a,", McSTORED},
+		{mc.Append, "nope", 0, 0, ",b", McNOT_STORED},
+	}
+	for i, tt := range tests {
+		code, err := tt.fn(tt.key, tt.flags, tt.exp, []byte(tt.value))
+		if err != nil || code != tt.code {
+			t.Fatalf("%d: expected %d, got %d %v", i, tt.code, code, err)
+		}
+	}
+
+	mc.NoReply = true
+	if code, err := mc.Set("foo", 0, 0, []byte("x")); err != nil || code != 0 {
+		t.Fatalf("noreply set: %d %v", code, err)
+	}
+	if code, err := mc.Add("foo", 0, 0, []byte("x")); err != nil || code != 0 {
+		t.Fatalf("noreply add: %d %v", code, err)
+	}
+	// the next command must line up with its own response.
+	if code, err := mc.Delete("foo"); err != nil || code != McDELETED {
+		t.Fatalf("delete after noreply: %d %v", code, err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"touch foo 60\r\n", "TOUCHED\r\n",
+		"touch nope 60\r\n", "NOT_FOUND\r\n",
+		"gat 120 foo\r\n", "VALUE foo 2 3\r\nbar\r\nEND\r\n",
+		"gats 120 foo\r\n", "VALUE foo 2 3 77\r\nbar\r\nEND\r\n",
+		"gat 120 nope\r\n", "END\r\n",
+		"mg foo c f v T300\r\n", "VA 3 c78 f2\r\nbar\r\n",
+		"mg foo T300\r\n", "HD\r\n",
+		"mg nope T300\r\n", "EN\r\n",
+	))
+
+	if code, err := mc.Touch("foo", 60); err != nil || code != McTOUCHED {
+		t.Fatalf("touch: %d %v", code, err)
+	}
+	if code, err := mc.Touch("nope", 60); err != nil || code != McNOT_FOUND {
+		t.Fatalf("touch miss: %d %v", code, err)
+	}
+
+	flags, v, code, err := mc.Gat("foo", 120)
+	if err != nil || code != McHIT || flags != 2 || string(v) != "bar" {
+		t.Fatalf("gat: %d %q %d %v", flags, v, code, err)
+	}
+	_, _, cas, code, err := mc.Gats("foo", 120)
+	if err != nil || code != McHIT || cas != 77 {
+		t.Fatalf("gats: %d %d %v", cas, code, err)
+	}
+	if _, _, code, err := mc.Gat("nope", 120); err != nil || code != McMISS {
+		t.Fatalf("gat miss: %d %v", code, err)
+	}
+
+	flags, v, cas, code, err = mc.MetaGat("foo", 300)
+	if err != nil || code != McVA || flags != 2 || cas != 78 || string(v) != "bar" {
+		t.Fatalf("metagat: %d %q %d %d %v", flags, v, cas, code, err)
+	}
+	if code, err := mc.MetaTouch("foo", 300); err != nil || code != McHD {
+		t.Fatalf("metatouch: %d %v", code, err)
+	}
+	if code, err := mc.MetaTouch("nope", 300); err != nil || code != McEN {
+		t.Fatalf("metatouch miss: %d %v", code, err)
+	}
+}
+
 func TestMeta(t *testing.T) {
 	mc := newcli()
 	{
@@ -33,7 +605,7 @@ func TestMeta(t *testing.T) {
 			t.Fatalf("metaset error: %v", err)
 		}
 		_, _, c, err := mc.MetaReceive()
-		if c != McOK {
+		if c != McHD {
 			t.Fatalf("metaset not stored: %d", c)
 		}
 	}
@@ -154,3 +726,269 @@ func TestBinary(t *testing.T) {
 	mcb.BinCorrupt()
 	mcb.BinReceive(it2)
 }
+
+// binServer answers each binary request with whatever fn returns, which may
+// be nothing for quiet commands.
+func binServer(t *testing.T, fn func(req *packet) []*packet) string {
+	return fakeServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			req := &packet{}
+			if err := req.read(r); err != nil {
+				return
+			}
+			for _, res := range fn(req) {
+				res.magic = responseMagic
+				res.opcode = req.opcode
+				res.opaque = req.opaque
+				res.keyLength = uint16(len(res.key))
+				res.extrasLength = uint8(len(res.extras))
+				res.bodyLength = uint32(len(res.extras) + len(res.key) + len(res.value))
+				if err := res.write(conn); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+func TestBinaryOpcodes(t *testing.T) {
+	var seen []string
+	mcb := newcliHost(binServer(t, func(req *packet) []*packet {
+		seen = append(seen, fmt.Sprintf("%x:%s:%d", req.opcode, req.key, len(req.extras)))
+		switch req.opcode {
+		case McOP_INCREMENT, McOP_DECREMENT:
+			delta := binary.BigEndian.Uint64(req.extras[:8])
+			if req.opcode == McOP_DECREMENT {
+				delta = 100 - delta
+			}
+			num := make([]byte, 8)
+			binary.BigEndian.PutUint64(num, delta)
+			return []*packet{{value: num}}
+		case McOP_VERSION:
+			return []*packet{{value: []byte("1.6.21")}}
+		case McOP_STAT:
+			return []*packet{
+				{key: "pid", value: []byte("123")},
+				{key: "uptime", value: []byte("10")},
+				{},
+			}
+		case McOP_GAT:
+			if binary.BigEndian.Uint32(req.extras) != 30 {
+				t.Errorf("bad gat expiration")
+			}
+			return []*packet{{extras: []byte{0, 0, 0, 5}, value: []byte("bar")}}
+		case McOP_DELETE:
+			return []*packet{{header: header{status: 0x01}}}
+		case McOP_SETQ, McOP_ADDQ, McOP_FLUSHQ:
+			return nil
+		}
+		return []*packet{{}}
+	}))
+
+	it := &Item{}
+	mcb.BinSetQ(&Item{Key: "foo", Value: []byte("bar")})
+	mcb.BinAddQ(&Item{Key: "foo", Value: []byte("bar")})
+	mcb.BinAppend(&Item{Key: "foo", Value: []byte("baz")})
+	if opcode, _, err := mcb.BinReceive(it); err != nil || opcode != McOP_APPEND {
+		t.Fatalf("bad append response: %x %v", opcode, err)
+	}
+
+	mcb.BinIncrement("cnt", 5, 0, 0)
+	if _, _, err := mcb.BinReceive(it); err != nil || it.Number != 5 {
+		t.Fatalf("bad incr response: %d %v", it.Number, err)
+	}
+	mcb.BinDecrement("cnt", 1, 0, 0)
+	if _, _, err := mcb.BinReceive(it); err != nil || it.Number != 99 {
+		t.Fatalf("bad decr response: %d %v", it.Number, err)
+	}
+
+	mcb.BinVersion()
+	if _, _, err := mcb.BinReceive(it); err != nil || string(it.Value) != "1.6.21" {
+		t.Fatalf("bad version response: %q %v", it.Value, err)
+	}
+
+	mcb.BinGat(&Item{Key: "foo", Expiration: 30})
+	if _, _, err := mcb.BinReceive(it); err != nil || string(it.Value) != "bar" || it.Flags != 5 {
+		t.Fatalf("bad gat response: %q %d %v", it.Value, it.Flags, err)
+	}
+
+	mcb.BinDelete(&Item{Key: "foo"})
+	if _, code, err := mcb.BinReceive(it); err != ErrItemNotFound || code != McERROR {
+		t.Fatalf("expected not found on delete, got: %d %v", code, err)
+	}
+
+	mcb.BinStat("")
+	stats, err := mcb.BinReceiveStats()
+	if err != nil {
+		t.Fatalf("bin stats error: %v", err)
+	}
+	if n, _ := stats.Uint("pid"); n != 123 || len(stats) != 2 {
+		t.Fatalf("bad bin stats: %v", stats)
+	}
+
+	mcb.BinFlushAllQ(10)
+	mcb.BinNoop()
+	if opcode, _, err := mcb.BinReceive(it); err != nil || opcode != McOP_NOOP {
+		t.Fatalf("bad noop response: %x %v", opcode, err)
+	}
+
+	expected := []string{"11:foo:8", "12:foo:8", "e:foo:0", "5:cnt:20", "6:cnt:20",
+		"b::0", "1d:foo:4", "4:foo:0", "10::0", "18::4", "a::0"}
+	if strings.Join(seen, ",") != strings.Join(expected, ",") {
+		t.Fatalf("bad requests seen: %v", seen)
+	}
+}
+
+// loopConn is an in-memory net.Conn that answers every read from resp,
+// starting over at the end, and drops everything written. Lets the response
+// paths be measured without a server or the network in the way.
+type loopConn struct {
+	resp []byte
+	off  int
+}
+
+func (l *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, l.resp[l.off:])
+	l.off = (l.off + n) % len(l.resp)
+	return n, nil
+}
+
+func (l *loopConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (l *loopConn) Close() error                       { return nil }
+func (l *loopConn) LocalAddr() net.Addr                { return nil }
+func (l *loopConn) RemoteAddr() net.Addr               { return nil }
+func (l *loopConn) SetDeadline(t time.Time) error      { return nil }
+func (l *loopConn) SetReadDeadline(t time.Time) error  { return nil }
+func (l *loopConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// loopClient returns a client already connected to a loopConn. The canned
+// response has to line up with the buffered reader so each request gets a
+// whole response, so keep it to a single request/response pair.
+func loopClient(resp []byte) *Client {
+	mc := newcliHost("loop")
+	lc := &loopConn{resp: resp}
+	mc.cn = &mcConn{conn: lc, b: bufio.NewReadWriter(bufio.NewReaderSize(lc, mc.RBufSize), bufio.NewWriterSize(lc, mc.WBufSize))}
+	return mc
+}
+
+func binResponse(opcode uint8, key string, flags uint32, value []byte) []byte {
+	pkt := &packet{}
+	pkt.magic = responseMagic
+	pkt.opcode = opcode
+	pkt.key = key
+	pkt.value = value
+	pkt.extras = make([]byte, 4)
+	binary.BigEndian.PutUint32(pkt.extras, flags)
+	pkt.extrasLength = 4
+	pkt.keyLength = uint16(len(key))
+	pkt.bodyLength = uint32(4 + len(key) + len(value))
+	var buf bytes.Buffer
+	pkt.write(&buf)
+	return buf.Bytes()
+}
+
+func textGetLoop(key string) (mc *Client, get func()) {
+	mc = loopClient([]byte("VALUE " + key + " 5 3\r\nbar\r\nEND\r\n"))
+	var buf []byte
+	get = func() {
+		_, value, code, err := mc.GetInto(key, buf)
+		if err != nil || code != McHIT || string(value) != "bar" {
+			panic(fmt.Sprintf("bad get: %q %d %v", value, code, err))
+		}
+		buf = value
+	}
+	return
+}
+
+func metaGetLoop(key string) (mc *Client, get func()) {
+	mc = loopClient([]byte("VA 3 f5\r\nbar\r\n"))
+	r := &MetaResponse{}
+	get = func() {
+		if err := mc.MetaGet(key, "v f"); err != nil {
+			panic(err)
+		}
+		if err := mc.MetaReceiveInto(r); err != nil || r.Code != McVA || string(r.Value) != "bar" {
+			panic(fmt.Sprintf("bad meta get: %q %d %v", r.Value, r.Code, err))
+		}
+	}
+	return
+}
+
+func binGetLoop(key string) (mc *Client, get func()) {
+	mc = loopClient(binResponse(McOP_GETK, key, 5, []byte("bar")))
+	item := &Item{}
+	var buf []byte
+	get = func() {
+		if _, err := mc.BinGet(key); err != nil {
+			panic(err)
+		}
+		opcode, _, err := mc.BinReceiveInto(item, buf)
+		if err != nil || opcode != McOP_GETK || item.Key != key || string(item.Value) != "bar" {
+			panic(fmt.Sprintf("bad bin get: %q %q %v", item.Key, item.Value, err))
+		}
+		buf = item.Value
+	}
+	return
+}
+
+// BinReceive hands back fresh values; only BinReceiveInto reuses memory.
+func TestBinReceiveFreshValue(t *testing.T) {
+	mc := loopClient(binResponse(McOP_GETK, "foo", 0, []byte("other")))
+	orig := []byte("ORIGINAL-PAYLOAD")
+	it := &Item{Key: "foo", Value: orig}
+	mc.BinSet(it)
+	mc.BinGet("foo")
+	if _, _, err := mc.BinReceive(it); err != nil || string(it.Value) != "other" {
+		t.Fatalf("bad get: %q %v", it.Value, err)
+	}
+	first := it.Value
+	mc.BinGet("foo")
+	if _, _, err := mc.BinReceive(it); err != nil {
+		t.Fatalf("bad get: %v", err)
+	}
+	first[0] = 'X'
+	if string(orig) != "ORIGINAL-PAYLOAD" || string(it.Value) != "other" {
+		t.Fatalf("values share memory: %q %q", orig, it.Value)
+	}
+}
+
+func TestZeroAllocResponses(t *testing.T) {
+	loops := map[string]func(key string) (*Client, func()){
+		"text":   textGetLoop,
+		"meta":   metaGetLoop,
+		"binary": binGetLoop,
+	}
+	for name, loop := range loops {
+		_, get := loop("foo")
+		// first call sizes the buffers.
+		get()
+		if n := testing.AllocsPerRun(100, get); n != 0 {
+			t.Errorf("%s: expected no allocations per get, got %v", name, n)
+		}
+	}
+}
+
+func BenchmarkTextGetInto(b *testing.B) {
+	_, get := textGetLoop("foo")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		get()
+	}
+}
+
+func BenchmarkMetaReceiveInto(b *testing.B) {
+	_, get := metaGetLoop("foo")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		get()
+	}
+}
+
+func BenchmarkBinReceiveInto(b *testing.B) {
+	_, get := binGetLoop("foo")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		get()
+	}
+}
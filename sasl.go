@@ -0,0 +1,175 @@
+// Connection authentication: SASL over the binary protocol for servers
+// started with -S, or a text protocol credentials set for servers with a -Y
+// auth file. Runs on each new connection before it's handed out.
+
+package mctester
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	McOP_SASL_LIST_MECHS = 0x20
+	McOP_SASL_AUTH       = 0x21
+	McOP_SASL_STEP       = 0x22
+)
+
+var (
+	ErrAuthFailed    = errors.New("authentication failed")
+	ErrAuthContinue  = errors.New("authentication continues")
+	ErrSASLMechanism = errors.New("SASL mechanism not offered by server")
+)
+
+// SASLMechanism drives the client side of a SASL exchange.
+type SASLMechanism interface {
+	Name() string
+	// Start returns the initial response, sent with the AUTH request.
+	Start() ([]byte, error)
+	// Next answers a server challenge, sent with a STEP request.
+	Next(challenge []byte) ([]byte, error)
+}
+
+type saslPlain struct {
+	username string
+	password string
+}
+
+// SASLPlain returns the PLAIN mechanism for a username and password.
+func SASLPlain(username string, password string) SASLMechanism {
+	return &saslPlain{username: username, password: password}
+}
+
+func (m *saslPlain) Name() string {
+	return "PLAIN"
+}
+
+func (m *saslPlain) Start() ([]byte, error) {
+	// authzid, authcid and password, NUL separated. No authzid.
+	return []byte("\x00" + m.username + "\x00" + m.password), nil
+}
+
+func (m *saslPlain) Next(challenge []byte) ([]byte, error) {
+	// PLAIN is a single step.
+	return nil, ErrAuthFailed
+}
+
+// saslRequest sends one SASL packet on cn and waits for the response.
+// Auth happens before the connection is in use, so nothing else can be in
+// flight and the client's shared packet is left alone.
+func saslRequest(cn *mcConn, opcode uint8, mech string, data []byte) (res *packet, err error) {
+	req := &packet{}
+	req.magic = requestMagic
+	req.opcode = opcode
+	req.key = mech
+	req.value = data
+	req.keyLength = uint16(len(mech))
+	req.bodyLength = uint32(len(mech) + len(data))
+	if err := req.write(cn.b); err != nil {
+		return nil, err
+	}
+	if err := cn.b.Flush(); err != nil {
+		return nil, err
+	}
+
+	res = &packet{}
+	err = res.read(cn.b)
+	if err != nil && res.magic == 0 {
+		// Nothing parsed, ie; the read failed or timed out.
+		return nil, err
+	}
+	if res.magic != responseMagic || res.opcode != opcode {
+		return nil, ErrUnexpectedResponse
+	}
+	return res, err
+}
+
+func saslListMechs(cn *mcConn) ([]string, error) {
+	res, err := saslRequest(cn, McOP_SASL_LIST_MECHS, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(res.value)), nil
+}
+
+// saslAuth checks the server offers the mechanism, then runs AUTH and as
+// many STEPs as the server asks for.
+func (c *Client) saslAuth(cn *mcConn) error {
+	if c.NetTimeout != 0 {
+		cn.conn.SetDeadline(time.Now().Add(c.NetTimeout))
+	}
+	mech := c.SASL.Name()
+	mechs, err := saslListMechs(cn)
+	if err != nil {
+		return err
+	}
+	offered := false
+	for _, m := range mechs {
+		if m == mech {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		return fmt.Errorf("%w: %s", ErrSASLMechanism, mech)
+	}
+
+	data, err := c.SASL.Start()
+	if err != nil {
+		return err
+	}
+	res, err := saslRequest(cn, McOP_SASL_AUTH, mech, data)
+	for err == ErrAuthContinue {
+		data, err = c.SASL.Next(res.value)
+		if err != nil {
+			return err
+		}
+		res, err = saslRequest(cn, McOP_SASL_STEP, mech, data)
+	}
+	return err
+}
+
+// SASLListMechs returns the mechanisms the server offers. Works without
+// SASL set, for probing a server.
+func (c *Client) SASLListMechs() (mechs []string, err error) {
+	err = c.runNow("", 0, func() error {
+		mechs, err = saslListMechs(c.cn)
+		return err
+	})
+	return
+}
+
+// textAuth logs in on a server with an auth file. Until it does, the server
+// rejects anything but a set carrying "username password" as its value; the
+// key is ignored.
+func (c *Client) textAuth(cn *mcConn) error {
+	if c.NetTimeout != 0 {
+		cn.conn.SetDeadline(time.Now().Add(c.NetTimeout))
+	}
+	creds := c.AuthUsername + " " + c.AuthPassword
+	b := cn.b
+	b.WriteString("set auth 0 0 ")
+	b.WriteString(strconv.Itoa(len(creds)))
+	b.WriteString("\r\n")
+	b.WriteString(creds)
+	b.WriteString("\r\n")
+	if err := b.Flush(); err != nil {
+		return err
+	}
+
+	line, err := b.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(line, []byte("STORED\r\n")) {
+		return nil
+	}
+	if bytes.HasPrefix(line, []byte("CLIENT_ERROR")) {
+		return fmt.Errorf("%w: %s", ErrAuthFailed, bytes.TrimSpace(line))
+	}
+	return textError(line)
+}
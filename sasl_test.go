@@ -0,0 +1,125 @@
+package mctester
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// saslServer accepts "user"/"pass" over PLAIN. cram is a stand-in for a
+// challenge based mechanism taking two steps.
+func saslServer(t *testing.T) string {
+	return binServer(t, func(req *packet) []*packet {
+		switch req.opcode {
+		case McOP_SASL_LIST_MECHS:
+			return []*packet{{value: []byte("CRAM PLAIN")}}
+		case McOP_SASL_AUTH:
+			switch {
+			case req.key == "PLAIN" && string(req.value) == "\x00user\x00pass":
+				return []*packet{{value: []byte("Authenticated")}}
+			case req.key == "CRAM":
+				return []*packet{{header: header{status: 0x09}, value: []byte("challenge")}}
+			}
+			return []*packet{{header: header{status: 0x08}}}
+		case McOP_SASL_STEP:
+			if req.key == "CRAM" && string(req.value) == "answer:challenge" {
+				return []*packet{{}}
+			}
+			return []*packet{{header: header{status: 0x08}}}
+		case McOP_NOOP:
+			return []*packet{{}}
+		}
+		t.Errorf("unexpected opcode before auth: %x", req.opcode)
+		return nil
+	})
+}
+
+type testCram struct{}
+
+func (m testCram) Name() string           { return "CRAM" }
+func (m testCram) Start() ([]byte, error) { return []byte("start"), nil }
+func (m testCram) Next(challenge []byte) ([]byte, error) {
+	return append([]byte("answer:"), challenge...), nil
+}
+
+type testUnknownMech struct{ testCram }
+
+func (m testUnknownMech) Name() string { return "SCRAM-SHA-256" }
+
+func TestSASL(t *testing.T) {
+	host := saslServer(t)
+
+	mc := newcliHost(host)
+	mechs, err := mc.SASLListMechs()
+	if err != nil || len(mechs) != 2 || mechs[1] != "PLAIN" {
+		t.Fatalf("bad mech list: %v %v", mechs, err)
+	}
+
+	for _, mech := range []SASLMechanism{SASLPlain("user", "pass"), testCram{}} {
+		mc := newcliHost(host)
+		mc.SASL = mech
+		mc.BinNoop()
+		it := &Item{}
+		if opcode, _, err := mc.BinReceive(it); err != nil || opcode != McOP_NOOP {
+			t.Fatalf("%s: bad noop after auth: %x %v", mech.Name(), opcode, err)
+		}
+	}
+
+	mc = newcliHost(host)
+	mc.SASL = SASLPlain("user", "wrong")
+	if _, err := mc.BinNoop(); err != ErrAuthFailed {
+		t.Fatalf("expected auth failure, got: %v", err)
+	}
+	if mc.Connected() || mc.ConnStats().ConnectFailures != 1 {
+		t.Fatalf("failed auth should fail the connect: %+v", mc.ConnStats())
+	}
+
+	mc = newcliHost(host)
+	mc.SASL = testUnknownMech{}
+	if _, err := mc.BinNoop(); !errors.Is(err, ErrSASLMechanism) {
+		t.Fatalf("expected unsupported mechanism, got: %v", err)
+	}
+}
+
+func TestSASLTimeout(t *testing.T) {
+	// Server reads the auth request and never answers.
+	host := fakeServer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	mc := newcliHost(host)
+	mc.NetTimeout = 50 * time.Millisecond
+	mc.SASL = SASLPlain("user", "pass")
+	_, err := mc.BinNoop()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+}
+
+func TestTextAuth(t *testing.T) {
+	host := scriptServer(t,
+		"set auth 0 0 9\r\nuser pass\r\n", "STORED\r\n",
+		"version\r\n", "VERSION 1.6.21\r\n",
+	)
+	mc := newcliHost(host)
+	mc.AuthUsername = "user"
+	mc.AuthPassword = "pass"
+	if v, err := mc.Version(); err != nil || v != "1.6.21" {
+		t.Fatalf("bad version after auth: %q %v", v, err)
+	}
+
+	host = scriptServer(t,
+		"set auth 0 0 10\r\nuser wrong\r\n", "CLIENT_ERROR authentication failure\r\n",
+	)
+	mc = newcliHost(host)
+	mc.AuthUsername = "user"
+	mc.AuthPassword = "wrong"
+	if _, err := mc.Version(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expected auth failure, got: %v", err)
+	}
+	if mc.Connected() {
+		t.Fatalf("failed auth should fail the connect")
+	}
+}
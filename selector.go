@@ -0,0 +1,227 @@
+// Picking a server for a key, for spreading load across a cluster.
+
+package mctester
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrNoServers       = errors.New("no servers to select from")
+	ErrBadWeights      = errors.New("need one non-negative weight per server, at least one above zero")
+	ErrUnknownSelector = errors.New("unknown server selector")
+)
+
+// ServerSelector maps keys to one of a fixed list of servers. Selectors are
+// immutable; build a new one to add or remove servers.
+type ServerSelector interface {
+	// Pick returns the index into Servers for key.
+	Pick(key string) int
+	Servers() []string
+}
+
+// HashFunc hashes a key for a modulo selector.
+type HashFunc func(key string) uint64
+
+// HashXX is xxHash64, the default.
+func HashXX(key string) uint64 {
+	return xxhash64(key)
+}
+
+// HashCRC32 is the crc32 hash used by libmemcached (MEMCACHED_HASH_CRC) and
+// php's memcache extension: the top half of the IEEE checksum, cut to 15
+// bits.
+func HashCRC32(key string) uint64 {
+	return uint64((crc32.ChecksumIEEE([]byte(key)) >> 16) & 0x7fff)
+}
+
+// NewSelector builds a selector by name: "modulo" (or empty) for xxhash
+// modulo, "crc32" for crc32 modulo, or "ketama". weights may be nil for an
+// even split.
+func NewSelector(kind string, servers []string, weights []int) (ServerSelector, error) {
+	switch kind {
+	case "", "modulo":
+		return NewModuloSelector(servers, weights, HashXX)
+	case "crc32":
+		return NewModuloSelector(servers, weights, HashCRC32)
+	case "ketama":
+		return NewKetamaSelector(servers, weights)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownSelector, kind)
+}
+
+func checkWeights(servers []string, weights []int) error {
+	if len(servers) == 0 {
+		return ErrNoServers
+	}
+	if weights == nil {
+		return nil
+	}
+	if len(weights) != len(servers) {
+		return ErrBadWeights
+	}
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return ErrBadWeights
+		}
+		total += w
+	}
+	if total == 0 {
+		return ErrBadWeights
+	}
+	return nil
+}
+
+type moduloSelector struct {
+	servers []string
+	hash    HashFunc
+	// server indexes, each repeated by its weight.
+	slots []int
+}
+
+// NewModuloSelector picks hash(key) % number of servers. With weights, each
+// server gets that many slots out of the total instead of one. Adding or
+// removing a server moves most keys.
+func NewModuloSelector(servers []string, weights []int, hash HashFunc) (ServerSelector, error) {
+	if err := checkWeights(servers, weights); err != nil {
+		return nil, err
+	}
+	s := &moduloSelector{servers: servers, hash: hash}
+	for i := range servers {
+		w := 1
+		if weights != nil {
+			w = weights[i]
+		}
+		for ; w > 0; w-- {
+			s.slots = append(s.slots, i)
+		}
+	}
+	return s, nil
+}
+
+func (s *moduloSelector) Pick(key string) int {
+	if len(s.slots) == 1 {
+		return s.slots[0]
+	}
+	return s.slots[s.hash(key)%uint64(len(s.slots))]
+}
+
+func (s *moduloSelector) Servers() []string {
+	return s.servers
+}
+
+type ketamaPoint struct {
+	hash   uint32
+	server int
+}
+
+type ketamaSelector struct {
+	servers []string
+	points  []ketamaPoint
+}
+
+// NewKetamaSelector places servers on a consistent hash continuum the same
+// way as libketama: 160 points per server, scaled by weight, hashed from
+// "server-N" with md5. Adding or removing a server only moves the keys on
+// its share of the continuum.
+func NewKetamaSelector(servers []string, weights []int) (ServerSelector, error) {
+	if err := checkWeights(servers, weights); err != nil {
+		return nil, err
+	}
+	total := 0
+	for i := range servers {
+		if weights != nil {
+			total += weights[i]
+		} else {
+			total++
+		}
+	}
+
+	s := &ketamaSelector{servers: servers}
+	for i, server := range servers {
+		w := 1
+		if weights != nil {
+			w = weights[i]
+		}
+		pct := float64(w) / float64(total)
+		// each md5 gives four points.
+		hashes := int(math.Floor(pct * 40.0 * float64(len(servers))))
+		for n := 0; n < hashes; n++ {
+			d := md5.Sum([]byte(server + "-" + strconv.Itoa(n)))
+			for k := 0; k < 4; k++ {
+				s.points = append(s.points, ketamaPoint{hash: ketamaHash(d, k), server: i})
+			}
+		}
+	}
+	sort.SliceStable(s.points, func(a, b int) bool {
+		return s.points[a].hash < s.points[b].hash
+	})
+	return s, nil
+}
+
+// ketamaHash takes the nth 32bit little endian chunk of an md5.
+func ketamaHash(d [16]byte, n int) uint32 {
+	return uint32(d[3+n*4])<<24 | uint32(d[2+n*4])<<16 | uint32(d[1+n*4])<<8 | uint32(d[n*4])
+}
+
+func (s *ketamaSelector) Pick(key string) int {
+	h := ketamaHash(md5.Sum([]byte(key)), 0)
+	// first point at or past the hash, wrapping around.
+	i := sort.Search(len(s.points), func(i int) bool { return s.points[i].hash >= h })
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.points[i].server
+}
+
+func (s *ketamaSelector) Servers() []string {
+	return s.servers
+}
+
+var ErrBadSplit = errors.New("need one non-negative percentage per server, adding up to 100")
+
+// TrafficSplit spreads load over servers by percentage regardless of key,
+// ie; to shift traffic between an old and a new build.
+type TrafficSplit struct {
+	// running total of percentages, one per server.
+	upto []int
+}
+
+func NewTrafficSplit(servers []string, percents []int) (*TrafficSplit, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	if len(percents) != len(servers) {
+		return nil, ErrBadSplit
+	}
+	s := &TrafficSplit{upto: make([]int, len(percents))}
+	total := 0
+	for i, p := range percents {
+		if p < 0 {
+			return nil, ErrBadSplit
+		}
+		total += p
+		s.upto[i] = total
+	}
+	if total != 100 {
+		return nil, ErrBadSplit
+	}
+	return s, nil
+}
+
+// Pick maps n, a random number from 0 to 99, to a server index.
+func (s *TrafficSplit) Pick(n int) int {
+	for i, upto := range s.upto {
+		if n < upto {
+			return i
+		}
+	}
+	return len(s.upto) - 1
+}
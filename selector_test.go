@@ -0,0 +1,240 @@
+package mctester
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestXXHash(t *testing.T) {
+	tests := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	}
+	for key, h := range tests {
+		if xxhash64(key) != h {
+			t.Fatalf("xxhash64(%q): expected %x, got %x", key, h, xxhash64(key))
+		}
+	}
+}
+
+func TestHashCRC32(t *testing.T) {
+	tests := map[string]uint64{
+		"foo":          3187,
+		"mctester:key": 26332,
+	}
+	for key, h := range tests {
+		if HashCRC32(key) != h {
+			t.Fatalf("HashCRC32(%q): expected %d, got %d", key, h, HashCRC32(key))
+		}
+	}
+}
+
+func selectorKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func countPicks(sel ServerSelector, keys []string) []int {
+	counts := make([]int, len(sel.Servers()))
+	for _, key := range keys {
+		counts[sel.Pick(key)]++
+	}
+	return counts
+}
+
+func TestSelectorSpread(t *testing.T) {
+	servers := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211"}
+	keys := selectorKeys(20000)
+	for _, kind := range []string{"modulo", "crc32", "ketama"} {
+		sel, err := NewSelector(kind, servers, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		for i, n := range countPicks(sel, keys) {
+			if n < 3500 || n > 6500 {
+				t.Fatalf("%s: uneven spread, server %d got %d keys", kind, i, n)
+			}
+		}
+
+		sel, err = NewSelector(kind, servers, []int{1, 0, 1, 2})
+		if err != nil {
+			t.Fatalf("%s weighted: %v", kind, err)
+		}
+		counts := countPicks(sel, keys)
+		if counts[1] != 0 {
+			t.Fatalf("%s: zero weight server got %d keys", kind, counts[1])
+		}
+		if counts[3] < 8500 || counts[3] > 11500 {
+			t.Fatalf("%s: double weight server got %d keys", kind, counts[3])
+		}
+	}
+}
+
+func TestKetamaRebalance(t *testing.T) {
+	servers := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}
+	keys := selectorKeys(20000)
+	before, _ := NewKetamaSelector(servers, nil)
+	after, _ := NewKetamaSelector(append(servers, "10.0.0.4:11211"), nil)
+
+	moved := 0
+	for _, key := range keys {
+		b, a := before.Pick(key), after.Pick(key)
+		if b != a {
+			if a != 3 {
+				t.Fatalf("key %s moved between existing servers %d -> %d", key, b, a)
+			}
+			moved++
+		}
+	}
+	// roughly a quarter should land on the new node.
+	if moved < 3500 || moved > 6500 {
+		t.Fatalf("expected about a quarter of keys to move, got %d", moved)
+	}
+}
+
+func TestSelectorErrors(t *testing.T) {
+	if _, err := NewSelector("modulo", nil, nil); err != ErrNoServers {
+		t.Fatalf("expected no servers error, got: %v", err)
+	}
+	for _, weights := range [][]int{{1}, {0, 0}, {1, -1}} {
+		if _, err := NewSelector("ketama", []string{"a", "b"}, weights); err != ErrBadWeights {
+			t.Fatalf("%v: expected bad weights error, got: %v", weights, err)
+		}
+	}
+	if _, err := NewSelector("rendezvous", []string{"a"}, nil); !errors.Is(err, ErrUnknownSelector) {
+		t.Fatalf("expected unknown selector error, got: %v", err)
+	}
+}
+
+// keyServer answers get and set, and records the keys it sees.
+type keyServer struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *keyServer) seen() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func (s *keyServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		parts := strings.Fields(line)
+		s.mu.Lock()
+		s.keys = append(s.keys, parts[1:]...)
+		s.mu.Unlock()
+		switch parts[0] {
+		case "get":
+			for _, key := range parts[1:] {
+				io.WriteString(conn, "VALUE "+key+" 0 1\r\nx\r\n")
+			}
+			io.WriteString(conn, "END\r\n")
+		case "set":
+			r.ReadString('\n')
+			io.WriteString(conn, "STORED\r\n")
+		}
+	}
+}
+
+func TestMultiClient(t *testing.T) {
+	var servers []string
+	fakes := make(map[string]*keyServer)
+	for i := 0; i < 3; i++ {
+		ks := &keyServer{}
+		host := fakeServer(t, ks.serve)
+		servers = append(servers, host)
+		fakes[host] = ks
+	}
+	sel, _ := NewKetamaSelector(servers, nil)
+	mc := NewMultiClient(sel, newcliHost)
+
+	keys := selectorKeys(30)
+	for _, key := range keys {
+		if _, _, code, err := mc.Get(key); err != nil || code != McHIT {
+			t.Fatalf("bad get for %s: %d %v", key, code, err)
+		}
+	}
+	res, err := mc.GetMulti(keys)
+	if err != nil || len(res) != len(keys) {
+		t.Fatalf("bad multiget: %d results, %v", len(res), err)
+	}
+	for i := range res {
+		if res[i].Code != McHIT {
+			t.Fatalf("multiget miss for %s", keys[i])
+		}
+	}
+	for _, c := range mc.Clients() {
+		c.Close()
+	}
+
+	for host, ks := range fakes {
+		seen := ks.seen()
+		if len(seen) == 0 {
+			t.Fatalf("server %s got no keys", host)
+		}
+		for _, key := range seen {
+			if servers[sel.Pick(key)] != host {
+				t.Fatalf("key %s sent to the wrong server", key)
+			}
+		}
+	}
+
+	// dropping a server keeps the other clients.
+	kept := mc.Clients()[0]
+	sel, _ = NewKetamaSelector(servers[:2], nil)
+	mc.SetSelector(sel, nil)
+	if len(mc.Clients()) != 2 || mc.Clients()[0] != kept {
+		t.Fatalf("expected existing clients kept after removing a server")
+	}
+
+	// a new client factory rebuilds every client.
+	mc.SetSelector(sel, func(host string) *Client {
+		c := newcliHost(host)
+		c.NetTimeout = 5 * time.Second
+		return c
+	})
+	for _, c := range mc.Clients() {
+		if c == kept || c.NetTimeout != 5*time.Second {
+			t.Fatalf("expected clients rebuilt with the new factory")
+		}
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	servers := []string{"old", "new", "spare"}
+	s, err := NewTrafficSplit(servers, []int{90, 10, 0})
+	if err != nil {
+		t.Fatalf("split error: %v", err)
+	}
+	counts := make([]int, len(servers))
+	for n := 0; n < 100; n++ {
+		counts[s.Pick(n)]++
+	}
+	if counts[0] != 90 || counts[1] != 10 || counts[2] != 0 {
+		t.Fatalf("bad split: %v", counts)
+	}
+
+	for _, pcts := range [][]int{{50, 50}, {50, 40, 0}, {110, -10, 0}} {
+		if _, err := NewTrafficSplit(servers, pcts); err != ErrBadSplit {
+			t.Fatalf("%v: expected bad split error, got: %v", pcts, err)
+		}
+	}
+}
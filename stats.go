@@ -0,0 +1,120 @@
+// Server statistics.
+
+package mctester
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Stats holds the results of a stats command, keyed by stat name.
+type Stats map[string]string
+
+// Uint returns a stat as an unsigned integer. ok is false if the stat is
+// missing or not a number.
+func (s Stats) Uint(name string) (n uint64, ok bool) {
+	v, found := s[name]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	return n, err == nil
+}
+
+// Float returns a stat as a float, ie; rusage_user.
+func (s Stats) Float(name string) (f float64, ok bool) {
+	v, found := s[name]
+	if !found {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil
+}
+
+// ByID groups stats named "prefix:id:field" by id, or "id:field" when
+// prefix is empty. Stats not matching the pattern are skipped.
+func (s Stats) ByID(prefix string) map[int]Stats {
+	out := make(map[int]Stats)
+	if prefix != "" {
+		prefix += ":"
+	}
+	for name, v := range s {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		name = name[len(prefix):]
+		i := strings.IndexByte(name, ':')
+		if i == -1 {
+			continue
+		}
+		id, err := strconv.Atoi(name[:i])
+		if err != nil {
+			continue
+		}
+		sub, ok := out[id]
+		if !ok {
+			sub = make(Stats)
+			out[id] = sub
+		}
+		sub[name[i+1:]] = v
+	}
+	return out
+}
+
+// Items splits up "stats items" output by slab class.
+func (s Stats) Items() map[int]Stats {
+	return s.ByID("items")
+}
+
+// Slabs splits up "stats slabs" output by slab class. Totals such as
+// active_slabs stay in s.
+func (s Stats) Slabs() map[int]Stats {
+	return s.ByID("")
+}
+
+// Conns splits up "stats conns" output by file descriptor.
+func (s Stats) Conns() map[int]Stats {
+	return s.ByID("")
+}
+
+// Stats runs "stats" with an optional subcommand, ie; settings, items,
+// slabs, conns, extstore.
+func (c *Client) Stats(subcommand string) (stats Stats, err error) {
+	err = c.runNow("", len(subcommand)+8, func() error {
+		b := c.cn.b
+		b.WriteString("stats")
+		if subcommand != "" {
+			b.WriteString(" ")
+			b.WriteString(subcommand)
+		}
+		b.WriteString("\r\n")
+		if err := b.Flush(); err != nil {
+			return err
+		}
+
+		stats = make(Stats)
+		for {
+			line, err := b.ReadBytes('\n')
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, []byte("END\r\n")) {
+				return nil
+			}
+			if !bytes.HasPrefix(line, []byte("STAT ")) {
+				return textError(line)
+			}
+			// STAT name value; some values have spaces in them.
+			parts := bytes.SplitN(line[5:len(line)-2], []byte(" "), 2)
+			if len(parts) != 2 {
+				return ErrUnexpectedResponse
+			}
+			stats[string(parts[0])] = string(parts[1])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,72 @@
+package mctester
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"stats\r\n", "STAT pid 1234\r\nSTAT rusage_user 0.512\r\nSTAT evictions 7\r\nSTAT version 1.6.21\r\nEND\r\n",
+		"stats items\r\n", "STAT items:1:number 5\r\nSTAT items:1:evicted 2\r\nSTAT items:12:number 1\r\nEND\r\n",
+		"stats slabs\r\n", "STAT 1:chunk_size 96\r\nSTAT 1:used_chunks 5\r\nSTAT active_slabs 1\r\nSTAT total_malloced 1048576\r\nEND\r\n",
+		"stats conns\r\n", "STAT 23:addr tcp:127.0.0.1:4242\r\nSTAT 23:state conn_parse_cmd\r\nEND\r\n",
+		"stats extstore\r\n", "ERROR\r\n",
+		"stats settings\r\n", "STAT maxbytes 67108864\r\nSTAT inter 127.0.0.1 ::1\r\nEND\r\n",
+	))
+
+	st, err := mc.Stats("")
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if n, ok := st.Uint("evictions"); !ok || n != 7 {
+		t.Fatalf("bad evictions: %d %v", n, ok)
+	}
+	if f, ok := st.Float("rusage_user"); !ok || f != 0.512 {
+		t.Fatalf("bad rusage_user: %f %v", f, ok)
+	}
+	if _, ok := st.Uint("version"); ok {
+		t.Fatalf("version should not parse as a number")
+	}
+	if _, ok := st.Uint("nope"); ok {
+		t.Fatalf("missing stat should not be ok")
+	}
+
+	st, err = mc.Stats("items")
+	if err != nil {
+		t.Fatalf("stats items error: %v", err)
+	}
+	items := st.Items()
+	if n, _ := items[1].Uint("evicted"); len(items) != 2 || n != 2 || items[12]["number"] != "1" {
+		t.Fatalf("bad items: %v", items)
+	}
+
+	st, err = mc.Stats("slabs")
+	if err != nil {
+		t.Fatalf("stats slabs error: %v", err)
+	}
+	slabs := st.Slabs()
+	if len(slabs) != 1 || slabs[1]["chunk_size"] != "96" || st["active_slabs"] != "1" {
+		t.Fatalf("bad slabs: %v", slabs)
+	}
+
+	st, err = mc.Stats("conns")
+	if err != nil {
+		t.Fatalf("stats conns error: %v", err)
+	}
+	if conns := st.Conns(); conns[23]["state"] != "conn_parse_cmd" {
+		t.Fatalf("bad conns: %v", conns)
+	}
+
+	// extstore isn't compiled in everywhere.
+	if _, err := mc.Stats("extstore"); err != ErrUnknownCommand {
+		t.Fatalf("expected unknown command error, got: %v", err)
+	}
+
+	st, err = mc.Stats("settings")
+	if err != nil {
+		t.Fatalf("stats settings error: %v", err)
+	}
+	if st["inter"] != "127.0.0.1 ::1" {
+		t.Fatalf("bad settings: %v", st)
+	}
+}
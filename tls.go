@@ -0,0 +1,80 @@
+// TLS connections, for servers started with -Z.
+
+package mctester
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrBadCA = errors.New("no certificates found in CA file")
+
+// TLSOptions describes how to build a client TLS config.
+type TLSOptions struct {
+	CAFile   string // PEM bundle to verify the server with; system roots if empty
+	CertFile string // client certificate, for servers verifying clients
+	KeyFile  string
+	// ServerName to verify; defaults to the host being dialed.
+	ServerName string
+	SkipVerify bool
+	// Number of sessions to cache for resumption. 0 disables resumption.
+	SessionCacheSize int
+}
+
+// NewTLSConfig builds a config from opts. Share the result between clients
+// to share the session cache, so new connections can resume sessions.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.SkipVerify,
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrBadCA
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if opts.SessionCacheSize > 0 {
+		conf.ClientSessionCache = tls.NewLRUClientSessionCache(opts.SessionCacheSize)
+	}
+	return conf, nil
+}
+
+// tlsHandshake wraps a fresh connection and completes the handshake within
+// ConnectTimeout, so handshake cost shows up as connect time and not on the
+// first command.
+func (c *Client) tlsHandshake(conn net.Conn) (*tls.Conn, error) {
+	conf := c.TLSConfig
+	if conf.ServerName == "" && !conf.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(c.Host)
+		if err != nil {
+			host = c.Host
+		}
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tc := tls.Client(conn, conf)
+	if c.ConnectTimeout != 0 {
+		tc.SetDeadline(time.Now().Add(c.ConnectTimeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
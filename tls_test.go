@@ -0,0 +1,142 @@
+package mctester
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert writes a self signed cert for 127.0.0.1, usable as CA, server
+// and client cert, and returns the cert and key paths.
+func testCert(t *testing.T) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mctester"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// tlsVersionServer answers version requests over TLS, requiring a client
+// cert signed by its own.
+func tlsVersionServer(t *testing.T, certFile string, keyFile string) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load server cert: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("fake server listen: %v", err)
+	}
+	return serveFake(t, l, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line != "version\r\n" {
+				io.WriteString(conn, "ERROR\r\n")
+				continue
+			}
+			io.WriteString(conn, "VERSION 1.6.21\r\n")
+		}
+	})
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile := testCert(t)
+	host := tlsVersionServer(t, certFile, keyFile)
+
+	conf, err := NewTLSConfig(TLSOptions{
+		CAFile:           certFile,
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		SessionCacheSize: 8,
+	})
+	if err != nil {
+		t.Fatalf("tls config error: %v", err)
+	}
+
+	// clients sharing a config share the session cache.
+	for i := 0; i < 2; i++ {
+		mc := newcliHost(host)
+		mc.TLSConfig = conf
+		if v, err := mc.Version(); err != nil || v != "1.6.21" {
+			t.Fatalf("bad version over tls: %q %v", v, err)
+		}
+		if resumed := mc.ConnStats().TLSResumed; resumed != uint64(i) {
+			t.Fatalf("connect %d: expected %d resumed sessions, got %d", i, i, resumed)
+		}
+	}
+
+	// no client cert.
+	conf, err = NewTLSConfig(TLSOptions{CAFile: certFile})
+	if err != nil {
+		t.Fatalf("tls config error: %v", err)
+	}
+	mc := newcliHost(host)
+	mc.TLSConfig = conf
+	if _, err := mc.Version(); err == nil {
+		t.Fatalf("expected error without a client cert")
+	}
+
+	// wrong server name.
+	conf, err = NewTLSConfig(TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "nope"})
+	if err != nil {
+		t.Fatalf("tls config error: %v", err)
+	}
+	mc = newcliHost(host)
+	mc.TLSConfig = conf
+	if _, err := mc.Version(); err == nil {
+		t.Fatalf("expected error with a mismatched server name")
+	}
+
+	if _, err := NewTLSConfig(TLSOptions{CAFile: keyFile}); err != ErrBadCA {
+		t.Fatalf("expected bad CA error, got: %v", err)
+	}
+}
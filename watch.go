@@ -0,0 +1,176 @@
+// Consumer for the watch log stream.
+
+package mctester
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchEvent is one parsed log line from a watch stream. Common fields are
+// pulled out; Fields holds every field as sent, including those.
+type WatchEvent struct {
+	TS     time.Time
+	GID    uint64
+	Type   string // ie; item_get, item_store, eviction
+	Key    string
+	Status string
+	Fields map[string]string
+	// Raw line, for anything that doesn't parse as key=value pairs.
+	Raw string
+}
+
+// Watcher reads a watch stream on its own connection.
+type Watcher struct {
+	Events <-chan WatchEvent
+	cn     *mcConn
+	done   chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	err    error
+}
+
+// Watch opens a new connection, switches it into watch mode for the given
+// log streams (ie; "fetchers", "mutations", "evictions") and sends parsed
+// lines to Events until Close is called or the connection fails. The
+// client's own connection is left alone.
+func (c *Client) Watch(streams ...string) (w *Watcher, err error) {
+	cn, err := c.connectToMc()
+	if err != nil {
+		return nil, err
+	}
+	if c.NetTimeout != 0 {
+		cn.conn.SetDeadline(time.Now().Add(c.NetTimeout))
+	}
+
+	b := cn.b
+	b.WriteString("watch")
+	for _, s := range streams {
+		b.WriteString(" ")
+		b.WriteString(s)
+	}
+	b.WriteString("\r\n")
+	if err := b.Flush(); err != nil {
+		cn.conn.Close()
+		return nil, err
+	}
+	line, err := b.ReadBytes('\n')
+	if err != nil {
+		cn.conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal(line, []byte("OK\r\n")) {
+		cn.conn.Close()
+		return nil, textError(line)
+	}
+	// The stream can go quiet for any length of time.
+	cn.conn.SetDeadline(time.Time{})
+
+	events := make(chan WatchEvent, 1024)
+	w = &Watcher{Events: events, cn: cn, done: make(chan struct{})}
+	go w.run(events)
+	return w, nil
+}
+
+func (w *Watcher) run(events chan<- WatchEvent) {
+	defer close(events)
+	r := w.cn.b.Reader
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			w.setErr(err)
+			return
+		}
+		select {
+		case events <- parseWatchLine(line):
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Watcher) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.done:
+		// Closed on purpose; the read error is expected.
+	default:
+		w.err = err
+	}
+}
+
+// Err returns the error that ended the stream, if it wasn't Close.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher and closes its connection. Events is closed once
+// the reader has stopped.
+func (w *Watcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		w.mu.Lock()
+		close(w.done)
+		w.mu.Unlock()
+		err = w.cn.conn.Close()
+	})
+	return err
+}
+
+// parseWatchLine parses "ts=123.456 gid=1 type=item_get key=foo ...".
+func parseWatchLine(line []byte) WatchEvent {
+	line = bytes.TrimRight(line, "\r\n")
+	e := WatchEvent{Raw: string(line), Fields: make(map[string]string)}
+	for _, field := range strings.Fields(e.Raw) {
+		i := strings.IndexByte(field, '=')
+		if i == -1 {
+			continue
+		}
+		name, v := field[:i], field[i+1:]
+		e.Fields[name] = v
+		switch name {
+		case "ts":
+			e.TS = parseWatchTS(v)
+		case "gid":
+			e.GID, _ = strconv.ParseUint(v, 10, 64)
+		case "type":
+			e.Type = v
+		case "key":
+			// keys are URI encoded in logs.
+			if k, err := url.PathUnescape(v); err == nil {
+				e.Key = k
+			} else {
+				e.Key = v
+			}
+		case "status":
+			e.Status = v
+		}
+	}
+	return e
+}
+
+// parseWatchTS parses seconds.microseconds.
+func parseWatchTS(v string) time.Time {
+	sec, usec := v, ""
+	if i := strings.IndexByte(v, '.'); i != -1 {
+		sec, usec = v[:i], v[i+1:]
+	}
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	var ns int64
+	if usec != "" {
+		// pad or cut the fraction out to nanoseconds.
+		frac := (usec + "000000000")[:9]
+		ns, _ = strconv.ParseInt(frac, 10, 64)
+	}
+	return time.Unix(s, ns)
+}
@@ -0,0 +1,68 @@
+package mctester
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"watch fetchers evictions\r\n",
+		"OK\r\n"+
+			"ts=1700000000.123456 gid=1 type=item_get key=foo%20bar status=found clsid=1 cfd=23 size=63\n"+
+			"ts=1700000001.5 gid=2 type=eviction key=baz fetch=no ttl=-1 la=1 clsid=1\n",
+		// hold the connection open until the watcher is closed.
+		"never\r\n", "",
+	))
+
+	w, err := mc.Watch("fetchers", "evictions")
+	if err != nil {
+		t.Fatalf("watch error: %v", err)
+	}
+
+	e := <-w.Events
+	if e.Type != "item_get" || e.Key != "foo bar" || e.Status != "found" || e.GID != 1 {
+		t.Fatalf("bad first event: %+v", e)
+	}
+	if !e.TS.Equal(time.Unix(1700000000, 123456000)) {
+		t.Fatalf("bad timestamp: %v", e.TS)
+	}
+	if e.Fields["cfd"] != "23" {
+		t.Fatalf("bad fields: %v", e.Fields)
+	}
+
+	e = <-w.Events
+	if e.Type != "eviction" || e.Key != "baz" || e.Fields["fetch"] != "no" {
+		t.Fatalf("bad second event: %+v", e)
+	}
+	if !e.TS.Equal(time.Unix(1700000001, 500000000)) {
+		t.Fatalf("bad timestamp: %v", e.TS)
+	}
+
+	w.Close()
+	select {
+	case _, ok := <-w.Events:
+		if ok {
+			t.Fatalf("unexpected event after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("events not closed after Close")
+	}
+	if w.Err() != nil {
+		t.Fatalf("unexpected error after close: %v", w.Err())
+	}
+	// the client's own connection isn't used by the watcher.
+	if mc.Connected() {
+		t.Fatalf("watch should use a dedicated connection")
+	}
+}
+
+func TestWatchRefused(t *testing.T) {
+	mc := newcliHost(scriptServer(t,
+		"watch bogus\r\n", "CLIENT_ERROR watch not allowed\r\n",
+	))
+	if _, err := mc.Watch("bogus"); !errors.Is(err, ErrClientError) {
+		t.Fatalf("expected client error from refused watch, got: %v", err)
+	}
+}